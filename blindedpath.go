@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"strings"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// inboundChannelLister lists the channels of the graph ending at a node, as
+// hops forwarded by the other end of each channel
+type inboundChannelLister interface {
+	inboundChannels(ctx context.Context, nodeId string) ([]Hop, error)
+}
+
+// blindedPath is a candidate path entering the blinded route at the
+// introduction node and leaving the public graph at a wallet peer. The
+// aggregated parameters are those of the blinded_payinfo, computed as in
+// BOLT 4, with the htlc bounds applying to the amount received by the
+// introduction node.
+type blindedPath struct {
+	IntroductionNode          string       `json:"introductionNode"`
+	Peer                      string       `json:"peer"`
+	FeeBaseMsat               int64        `json:"feeBaseMsat"`
+	FeeProportionalMillionths int64        `json:"feeProportionalMillionths"`
+	CltvExpiryDelta           int64        `json:"cltvExpiryDelta"`
+	HtlcMinimumMsat           int64        `json:"htlcMinimumMsat"`
+	HtlcMaximumMsat           int64        `json:"htlcMaximumMsat"`
+	Hops                      PaymentRoute `json:"hops"`
+}
+
+// findBlindedPaths selects, among the channels toward the wallet peers able
+// to forward msat, up to maxPaths introduction nodes, the cheapest path of
+// each peer first so that the paths are spread over the peers
+func findBlindedPaths(
+	ctx context.Context,
+	il inboundChannelLister,
+	peers []string,
+	msat int64,
+	maxPaths int64,
+) ([]blindedPath, error) {
+	isPeer := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		isPeer[strings.ToLower(peer)] = true
+	}
+
+	perPeer := make([][]PaymentRoute, 0, len(peers))
+	for _, peer := range peers {
+		hops, err := il.inboundChannels(ctx, peer)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		var candidates []PaymentRoute
+		for _, hop := range hops {
+			// another peer as introduction node would reveal the wallet
+			if isPeer[strings.ToLower(hop.NodeId)] {
+				continue
+			}
+			route := PaymentRoute{hop}
+			if _, err := validateRoute(route, msat); err != nil {
+				continue
+			}
+			candidates = append(candidates, route)
+		}
+		sortRoutes(candidates, msat)
+		perPeer = append(perPeer, candidates)
+	}
+
+	var r []blindedPath
+	seen := map[string]bool{}
+	for round := 0; int64(len(r)) < maxPaths; round++ {
+		added := false
+		for i, candidates := range perPeer {
+			if round >= len(candidates) || int64(len(r)) >= maxPaths {
+				continue
+			}
+			added = true
+			route := candidates[round]
+			intro := strings.ToLower(route[0].NodeId)
+			if seen[intro] {
+				continue
+			}
+			seen[intro] = true
+			r = append(r, newBlindedPath(route, strings.ToLower(peers[i])))
+		}
+		if !added {
+			break
+		}
+	}
+	if len(r) == 0 {
+		log.Printf("no introduction node toward peers %v\n", peers)
+	}
+	return r, nil
+}
+
+func newBlindedPath(route PaymentRoute, peer string) blindedPath {
+	r := blindedPath{
+		IntroductionNode: strings.ToLower(route[0].NodeId),
+		Peer:             peer,
+		Hops:             route,
+	}
+	r.FeeBaseMsat, r.FeeProportionalMillionths = aggregateBlindedFees(route)
+	r.CltvExpiryDelta = routeCltv(route)
+	r.HtlcMinimumMsat, r.HtlcMaximumMsat = aggregateBlindedHtlcBounds(route)
+	return r
+}
+
+// aggregateBlindedFees folds the route fees, from the last hop back to the
+// first, into a single base fee and proportional fee rounded up
+func aggregateBlindedFees(route PaymentRoute) (baseMsat, ppm int64) {
+	ceilMillionth := func(v int64) int64 {
+		return (v + 1_000_000 - 1) / 1_000_000
+	}
+	for i := len(route) - 1; i >= 0; i-- {
+		hopBase := int64(route[i].FeeBaseMsat)
+		hopPpm := int64(route[i].FeeProportionalMillionths)
+		baseMsat = ceilMillionth(hopBase*1_000_000 + baseMsat*(1_000_000+hopPpm))
+		ppm = ceilMillionth((ppm+hopPpm)*1_000_000 + ppm*hopPpm)
+	}
+	return baseMsat, ppm
+}
+
+// aggregateBlindedHtlcBounds returns the range of amounts the first hop
+// node can receive so that each hop forwards within its htlc limits. A hop
+// without maximum does not bound the range.
+func aggregateBlindedHtlcBounds(route PaymentRoute) (minMsat, maxMsat int64) {
+	maxMsat = math.MaxInt64
+	for i := len(route) - 1; i >= 0; i-- {
+		hop := route[i]
+		minMsat = max(minMsat, hop.HtlcMinimumMsat)
+		minMsat += hopFeeMsat(hop, minMsat)
+		if hop.HtlcMaximumMsat > 0 {
+			maxMsat = min(maxMsat, hop.HtlcMaximumMsat)
+		}
+		if maxMsat != math.MaxInt64 {
+			maxMsat += hopFeeMsat(hop, maxMsat)
+		}
+	}
+	if maxMsat == math.MaxInt64 {
+		maxMsat = 0
+	}
+	return minMsat, maxMsat
+}
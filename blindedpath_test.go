@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+type mapInboundLister map[string][]Hop
+
+func (m mapInboundLister) inboundChannels(_ context.Context, nodeId string) ([]Hop, error) {
+	return m[nodeId], nil
+}
+
+func Test_aggregateBlindedPayInfo(t *testing.T) {
+	route := PaymentRoute{
+		{FeeBaseMsat: 1000, FeeProportionalMillionths: 100, HtlcMinimumMsat: 1000, HtlcMaximumMsat: 1_000_000},
+		{FeeBaseMsat: 500, FeeProportionalMillionths: 1000, HtlcMinimumMsat: 2000},
+	}
+
+	baseMsat, ppm := aggregateBlindedFees(route)
+	expected := []int64{1501, 1101}
+	if !reflect.DeepEqual(expected, []int64{baseMsat, ppm}) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, []int64{baseMsat, ppm})
+	}
+
+	minMsat, maxMsat := aggregateBlindedHtlcBounds(route)
+	expected = []int64{3502, 1_001_100}
+	if !reflect.DeepEqual(expected, []int64{minMsat, maxMsat}) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, []int64{minMsat, maxMsat})
+	}
+}
+
+func Test_findBlindedPaths(t *testing.T) {
+	il := mapInboundLister{
+		"p1": {
+			{NodeId: "a", ShortChannelId: 1, FeeBaseMsat: 2000, CltvExpiryDelta: 40},
+			{NodeId: "b", ShortChannelId: 2, FeeBaseMsat: 1000, CltvExpiryDelta: 40},
+			// unable to forward the amount
+			{NodeId: "c", ShortChannelId: 3, HtlcMaximumMsat: 1000},
+			// another peer would reveal the wallet
+			{NodeId: "p2", ShortChannelId: 4},
+		},
+		"p2": {
+			{NodeId: "b", ShortChannelId: 5, FeeBaseMsat: 500, CltvExpiryDelta: 80},
+			{NodeId: "d", ShortChannelId: 6, FeeBaseMsat: 3000, CltvExpiryDelta: 40},
+		},
+	}
+
+	ctx := context.Background()
+	r, err := findBlindedPaths(ctx, il, []string{"p1", "p2"}, 100_000, 3)
+	tu.Must(t, err)
+
+	// the best path of each peer first, then the next best with a new
+	// introduction node
+	expected := []blindedPath{
+		{
+			IntroductionNode: "b", Peer: "p1", FeeBaseMsat: 1000, CltvExpiryDelta: 40,
+			HtlcMinimumMsat: 1000, Hops: PaymentRoute{il["p1"][1]},
+		},
+		{
+			IntroductionNode: "a", Peer: "p1", FeeBaseMsat: 2000, CltvExpiryDelta: 40,
+			HtlcMinimumMsat: 2000, Hops: PaymentRoute{il["p1"][0]},
+		},
+		{
+			IntroductionNode: "d", Peer: "p2", FeeBaseMsat: 3000, CltvExpiryDelta: 40,
+			HtlcMinimumMsat: 3000, Hops: PaymentRoute{il["p2"][1]},
+		},
+	}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+}
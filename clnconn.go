@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"master.private/bstd.git/jsonrpc"
+	"master.private/bstd.git/stackerr"
+)
+
+var errLnUnavailable = errors.New("lightning node unavailable")
+
+// clnPool spreads the rpc calls over a fixed number of CLN connections, as
+// each connection serves a single call at a time
+type clnPool struct {
+	conns  []*clnConn
+	free   chan *clnConn
+	infoMu sync.Mutex
+	info   clnInfo
+}
+
+// clnInfo is the getinfo result of the last established connection
+type clnInfo struct {
+	Id      string `json:"id"`
+	Version string `json:"version"`
+}
+
+func newClnPool(network, address string, size int64) *clnPool {
+	if size < 1 {
+		panic(fmt.Sprintf("invalid cln pool size: %d", size))
+	}
+	p := &clnPool{
+		conns: make([]*clnConn, 0, size),
+		free:  make(chan *clnConn, size),
+	}
+	for range size {
+		c := newClnConn(network, address)
+		c.onConnect = p.setInfo
+		p.conns = append(p.conns, c)
+		p.free <- c
+	}
+	return p
+}
+
+// nodeInfo returns the info of the node, connecting when no connection has
+// been established yet
+func (p *clnPool) nodeInfo(ctx context.Context) (clnInfo, error) {
+	p.infoMu.Lock()
+	info := p.info
+	p.infoMu.Unlock()
+	if info.Version != "" {
+		return info, nil
+	}
+	err := p.Call(ctx, "getinfo", struct{}{}, &info)
+	if err != nil {
+		return info, stackerr.Wrap(err)
+	}
+	return info, nil
+}
+
+func (p *clnPool) setInfo(info clnInfo) {
+	p.infoMu.Lock()
+	defer p.infoMu.Unlock()
+	if p.info.Version != info.Version {
+		log.Printf("connected to cln %s, %s\n", info.Version, info.Id)
+	}
+	p.info = info
+}
+
+// Call waits for a free connection and does the rpc call on it
+func (p *clnPool) Call(
+	ctx context.Context, method string, params, result interface{},
+) error {
+	var c *clnConn
+	select {
+	case c = <-p.free:
+	case <-ctx.Done():
+		return stackerr.Wrap(ctx.Err())
+	}
+	defer func() { p.free <- c }()
+	return c.Call(ctx, method, params, result)
+}
+
+func (p *clnPool) Close() error {
+	var errs []error
+	for _, c := range p.conns {
+		errs = append(errs, c.Close())
+	}
+	return stackerr.Wrap(errors.Join(errs...))
+}
+
+// clnConn is a connection to the CLN rpc socket, dialed on first use and
+// redialed, with exponential backoff, after the transport fails
+type clnConn struct {
+	network   string
+	address   string
+	mu        sync.Mutex
+	conn      net.Conn
+	client    *jsonrpc.Client
+	backoff   time.Duration
+	nextDial  time.Time
+	onConnect func(clnInfo)
+}
+
+const (
+	clnMinBackoff = time.Second
+	clnMaxBackoff = time.Minute
+)
+
+func newClnConn(network, address string) *clnConn {
+	return &clnConn{
+		network: network,
+		address: address,
+		backoff: clnMinBackoff,
+	}
+}
+
+// Call does the rpc call, reconnecting once when the current connection is
+// found broken. Errors caused by the lightning node being unreachable wrap
+// errLnUnavailable.
+func (c *clnConn) Call(
+	ctx context.Context, method string, params, result interface{},
+) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	const nMaxAttempts = 2
+	var err error
+	for range nMaxAttempts {
+		reused := c.client != nil
+		err = c.connect(ctx)
+		if err != nil {
+			return stackerr.Wrap(errors.Join(ctx.Err(), err))
+		}
+		err = c.callWithContext(ctx, method, params, result)
+		if err != nil && ctx.Err() != nil {
+			// the call may be abandoned mid-response
+			c.discard()
+			return stackerr.Wrap(errors.Join(ctx.Err(), err))
+		}
+		if !isClnTransportErr(err) {
+			return err
+		}
+		log.Printf("cln connection broken calling %s: %s\n", method, err)
+		c.discard()
+		if !reused {
+			break
+		}
+	}
+	return stackerr.Wrap(fmt.Errorf("%w: %w", errLnUnavailable, err))
+}
+
+// callWithContext bounds the call by the context deadline, and interrupts
+// it when the context is canceled
+func (c *clnConn) callWithContext(
+	ctx context.Context, method string, params, result interface{},
+) error {
+	// the callback uses its own copy, as the connection is discarded once
+	// the call is abandoned
+	conn := c.conn
+	deadline, _ := ctx.Deadline()
+	err := conn.SetDeadline(deadline)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+		conn.SetDeadline(time.Now())
+	})
+	defer func() {
+		if !stop() {
+			<-interrupted
+		}
+		conn.SetDeadline(time.Time{})
+	}()
+	err = c.client.Call(method, params, result)
+	if err != nil && !deadline.IsZero() && !time.Now().Before(deadline) {
+		// the socket deadline may expire just before the context one, which
+		// tells the call was abandoned
+		<-ctx.Done()
+	}
+	return err
+}
+
+func (c *clnConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	c.conn = nil
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// connect dials the socket when there's no connection, unless the backoff
+// since the last failed dial has not elapsed. The node info is queried on
+// each new connection, as the node may have been upgraded while away.
+func (c *clnConn) connect(ctx context.Context) error {
+	if c.client != nil {
+		return nil
+	}
+	if time.Now().Before(c.nextDial) {
+		return fmt.Errorf("%w: waiting to reconnect", errLnUnavailable)
+	}
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		c.delayNextDial()
+		return fmt.Errorf("%w: %w", errLnUnavailable, err)
+	}
+	c.conn = conn
+	c.client = jsonrpc.NewClient(newBufferedConn(conn))
+
+	var info clnInfo
+	err = c.callWithContext(ctx, "getinfo", struct{}{}, &info)
+	if err != nil {
+		c.discard()
+		// the caller giving up tells nothing of the node
+		if ctx.Err() == nil {
+			c.delayNextDial()
+		}
+		return fmt.Errorf("%w: %w", errLnUnavailable, err)
+	}
+	c.backoff = clnMinBackoff
+	if c.onConnect != nil {
+		c.onConnect(info)
+	}
+	return nil
+}
+
+func (c *clnConn) delayNextDial() {
+	c.nextDial = time.Now().Add(c.backoff)
+	c.backoff = min(c.backoff*2, clnMaxBackoff)
+}
+
+func (c *clnConn) discard() {
+	c.client.Close()
+	c.client = nil
+	c.conn = nil
+}
+
+// isClnTransportErr tells if the call failed in a way that leaves the
+// connection unusable. Rpc errors and decoding errors consume the whole
+// response, so the connection is still in sync.
+func isClnTransportErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	var (
+		rpcErr       *jsonrpc.RpcError
+		syntaxErr    *json.SyntaxError
+		unmarshalErr *json.UnmarshalTypeError
+	)
+	return !errors.As(err, &rpcErr) &&
+		!errors.As(err, &syntaxErr) &&
+		!errors.As(err, &unmarshalErr)
+}
+
+// bufferedConn buffers the reads from the connection, as the jsonrpc client
+// reads the responses one byte at a time
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{conn, bufio.NewReader(conn)}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
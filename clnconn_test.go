@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+// serveCalls answers nCalls getinfo calls on each accepted connection, then
+// closes it, like lightningd does when restarting
+func serveCalls(l net.Listener, nCalls int) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(conn)
+		for range nCalls {
+			var req struct {
+				Id int64 `json:"id"`
+			}
+			line, err := r.ReadBytes('\n')
+			if err != nil || json.Unmarshal(line, &req) != nil {
+				break
+			}
+			res, _ := json.Marshal(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      req.Id,
+				"result":  map[string]string{"id": "02aa", "version": "v24.11"},
+			})
+			conn.Write(append(res, '\n', '\n'))
+		}
+		conn.Close()
+	}
+}
+
+func Test_clnConnReconnect(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "lightning-rpc")
+	l, err := net.Listen("unix", address)
+	tu.Must(t, err)
+	// one getinfo on connect, then the call
+	go serveCalls(l, 2)
+
+	ctx := context.Background()
+	c := newClnConn("unix", address)
+	defer c.Close()
+	var r struct {
+		Id string `json:"id"`
+	}
+	for i := range 3 {
+		r.Id = ""
+		tu.MustIdx(t, i, c.Call(ctx, "getinfo", struct{}{}, &r))
+		if r.Id != "02aa" {
+			t.Fatal("unexpected:", r.Id)
+		}
+	}
+
+	l.Close()
+	err = c.Call(ctx, "getinfo", struct{}{}, &r)
+	if !errors.Is(err, errLnUnavailable) {
+		t.Fatal("expecting errLnUnavailable, got:", err)
+	}
+}
+
+func Test_clnConnDeadline(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "lightning-rpc")
+	l, err := net.Listen("unix", address)
+	tu.Must(t, err)
+	defer l.Close()
+	// a hung lightningd, accepting connections but never answering
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	c := newClnConn("unix", address)
+	defer c.Close()
+	var r struct{}
+	err = c.Call(ctx, "getinfo", struct{}{}, &r)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expecting context.DeadlineExceeded, got:", err)
+	}
+	if c.client != nil {
+		t.Fatal("expecting the abandoned connection to be discarded")
+	}
+	// the next caller may dial again at once
+	if !c.nextDial.IsZero() {
+		t.Fatal("unexpected reconnection delay after the caller deadline")
+	}
+}
+
+func Test_clnConnCancel(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "lightning-rpc")
+	l, err := net.Listen("unix", address)
+	tu.Must(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// the context expiry races with the end of the abandoned call, the
+	// socket deadline being set to the context deadline
+	for i := range 50 {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), time.Duration(1+i%5)*time.Millisecond,
+		)
+		if i%2 == 0 {
+			go cancel()
+		}
+		c := newClnConn("unix", address)
+		var r struct{}
+		err = c.Call(ctx, "getinfo", struct{}{}, &r)
+		if ctx.Err() == nil || !errors.Is(err, ctx.Err()) {
+			t.Fatal("expecting the context error, got:", err)
+		}
+		c.Close()
+		cancel()
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"master.private/bstd.git/jsonrpc"
+	"master.private/bstd.git/stackerr"
+)
+
+// onion failure codes of the probe outcomes
+const (
+	failcodeTemporaryChannelFailure       = 0x1007
+	failcodeAmountBelowMinimum            = 0x100b
+	failcodeFeeInsufficient               = 0x100c
+	failcodeIncorrectCltvExpiry           = 0x100d
+	failcodeChannelDisabled               = 0x1014
+	failcodePermanentChannelFailure       = 0x4008
+	failcodeUnknownNextPeer               = 0x400a
+	failcodeIncorrectOrUnknownPaymentHash = 0x400f
+)
+
+const (
+	// waitsendpay error codes
+	clnPayDestinationPermFail = 203
+	clnPayTryOtherRoute       = 204
+
+	clnProbeFinalCltv          = 18
+	clnProbeWaitTimeoutSeconds = 60
+)
+
+// clnSendpayHop is a hop in the sendpay format, where id is the node
+// receiving the htlc
+type clnSendpayHop struct {
+	Id         string `json:"id"`
+	Channel    string `json:"channel"`
+	AmountMsat int64  `json:"amount_msat"`
+	Delay      int64  `json:"delay"`
+}
+
+// clnPayFailure is the data of a failed waitsendpay
+type clnPayFailure struct {
+	ErringIndex int `json:"erring_index"`
+	Failcode    int `json:"failcode"`
+}
+
+// probe sends an htlc with a random payment hash along the route, which
+// starts at the node, and waits for the failure telling how far it went.
+// The probes are sent on their own connection, leaving the pool to the route
+// requests.
+func (lr *lnRouter) probe(
+	ctx context.Context, route PaymentRoute, toPubkey string, msat int64,
+) ([]PaymentOutcome, error) {
+	var paymentHash [32]byte
+	_, err := rand.Read(paymentHash[:])
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	params := struct {
+		Route       []clnSendpayHop `json:"route"`
+		PaymentHash string          `json:"payment_hash"`
+	}{
+		clnSendpayRoute(route, toPubkey, msat),
+		hex.EncodeToString(paymentHash[:]),
+	}
+	err = lr.probeClient.Call(ctx, "sendpay", params, &struct{}{})
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	waitParams := struct {
+		PaymentHash string `json:"payment_hash"`
+		Timeout     int64  `json:"timeout"`
+	}{params.PaymentHash, clnProbeWaitTimeoutSeconds}
+	err = lr.probeClient.Call(ctx, "waitsendpay", waitParams, &struct{}{})
+	if err == nil {
+		// nobody knows the preimage of a random hash
+		return nil, stackerr.Wrap(fmt.Errorf("probe unexpectedly succeeded"))
+	}
+	var rpcErr *jsonrpc.RpcError
+	if !errors.As(err, &rpcErr) ||
+		(rpcErr.Code != clnPayTryOtherRoute && rpcErr.Code != clnPayDestinationPermFail) {
+		return nil, stackerr.Wrap(err)
+	}
+	var failure clnPayFailure
+	b, err := json.Marshal(rpcErr.Data)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	err = json.Unmarshal(b, &failure)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return clnProbeOutcomes(route, toPubkey, msat, failure), nil
+}
+
+// clnSendpayRoute converts the route to the sendpay format, with the amount
+// and the relative cltv of each htlc
+func clnSendpayRoute(route PaymentRoute, toPubkey string, msat int64) []clnSendpayHop {
+	amounts := hopAmountsMsat(route, msat)
+	r := make([]clnSendpayHop, len(route))
+	delay := int64(clnProbeFinalCltv)
+	for i := len(route) - 1; i >= 0; i-- {
+		next := toPubkey
+		if i+1 < len(route) {
+			next = route[i+1].NodeId
+			delay += int64(route[i+1].CltvExpiryDelta)
+		}
+		r[i] = clnSendpayHop{
+			Id:         strings.ToLower(next),
+			Channel:    shortChannelIdToString(route[i].ShortChannelId),
+			AmountMsat: amounts[i],
+			Delay:      delay,
+		}
+	}
+	return r
+}
+
+// clnProbeOutcomes derives the channel outcomes from the probe failure. The
+// channels before the erring node carried their amount, and the failure
+// tells what happened at the erring node channel.
+func clnProbeOutcomes(
+	route PaymentRoute, toPubkey string, msat int64, failure clnPayFailure,
+) []PaymentOutcome {
+	amounts := hopAmountsMsat(route, msat)
+	outcome := func(i int, result string) PaymentOutcome {
+		next := toPubkey
+		if i+1 < len(route) {
+			next = route[i+1].NodeId
+		}
+		return PaymentOutcome{
+			ShortChannelId: route[i].ShortChannelId,
+			Direction:      channelDirection(route[i].NodeId, next),
+			AmountMsat:     amounts[i],
+			Result:         result,
+		}
+	}
+
+	// the hops before the erring node carried their amount, all of them
+	// when the destination rejected the unknown payment hash
+	nCarried := min(failure.ErringIndex, len(route))
+	if failure.Failcode == failcodeIncorrectOrUnknownPaymentHash {
+		nCarried = len(route)
+	}
+	var r []PaymentOutcome
+	for i := range nCarried {
+		r = append(r, outcome(i, outcomeSuccess))
+	}
+	if nCarried == len(route) {
+		return r
+	}
+
+	var result string
+	switch failure.Failcode {
+	case failcodeTemporaryChannelFailure:
+		result = outcomeTemporaryChannelFailure
+	case failcodeChannelDisabled:
+		result = outcomeChannelDisabled
+	case failcodeUnknownNextPeer:
+		result = outcomeUnknownNextPeer
+	case failcodePermanentChannelFailure:
+		result = outcomePermanentChannelFailure
+	case failcodeFeeInsufficient:
+		result = outcomeFeeInsufficient
+	case failcodeIncorrectCltvExpiry:
+		result = outcomeIncorrectCltvExpiry
+	case failcodeAmountBelowMinimum:
+		result = outcomeAmountBelowMinimum
+	default:
+		return r
+	}
+	return append(r, outcome(failure.ErringIndex, result))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_clnSendpayRoute(t *testing.T) {
+	const (
+		a = "02aa"
+		b = "02bb"
+		c = "02cc"
+	)
+	route := PaymentRoute{
+		{NodeId: a, ShortChannelId: 1 << 40, CltvExpiryDelta: 6},
+		{NodeId: b, ShortChannelId: 2 << 40, CltvExpiryDelta: 40, FeeBaseMsat: 1000},
+	}
+	expected := []clnSendpayHop{
+		{Id: b, Channel: "1x0x0", AmountMsat: 101_000, Delay: 58},
+		{Id: c, Channel: "2x0x0", AmountMsat: 100_000, Delay: 18},
+	}
+	r := clnSendpayRoute(route, c, 100_000)
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+}
+
+func Test_clnProbeOutcomes(t *testing.T) {
+	const (
+		a = "02aa"
+		b = "02bb"
+		c = "02cc"
+	)
+	route := PaymentRoute{
+		{NodeId: a, ShortChannelId: 1},
+		{NodeId: c, ShortChannelId: 2, FeeBaseMsat: 1000},
+	}
+
+	// the second node has no liquidity to the destination
+	r := clnProbeOutcomes(route, b, 100_000, clnPayFailure{
+		ErringIndex: 1, Failcode: failcodeTemporaryChannelFailure,
+	})
+	expected := []PaymentOutcome{
+		{1, 0, 101_000, outcomeSuccess},
+		{2, 1, 100_000, outcomeTemporaryChannelFailure},
+	}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	// the destination was reached
+	r = clnProbeOutcomes(route, b, 100_000, clnPayFailure{
+		ErringIndex: 2, Failcode: failcodeIncorrectOrUnknownPaymentHash,
+	})
+	expected = []PaymentOutcome{
+		{1, 0, 101_000, outcomeSuccess},
+		{2, 1, 100_000, outcomeSuccess},
+	}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+}
+
+func Test_lnRouterProbe(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "lightning-rpc")
+	l, err := net.Listen("unix", address)
+	tu.Must(t, err)
+	defer l.Close()
+	f := &fakeCln{
+		from:    "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		to:      "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+		feeBase: 1000,
+		waiting: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	go f.serve(l)
+
+	ctx := context.Background()
+	lr := NewLnRouter("unix", address, 1, 1, time.Hour, 0)
+	defer lr.Close()
+	route := PaymentRoute{{NodeId: f.from, ShortChannelId: 964531182376517632}}
+	type probeResult struct {
+		outcomes []PaymentOutcome
+		err      error
+	}
+	done := make(chan probeResult)
+	go func() {
+		outcomes, err := lr.probe(ctx, route, f.to, 1000)
+		done <- probeResult{outcomes, err}
+	}()
+	<-f.waiting
+
+	// the waiting probe leaves the single pool connection to the requests
+	findCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err = lr.FindRoutes(findCtx, nil, f.to, 1000, RouteExclusions{}, RouteLimits{})
+	close(f.release)
+	tu.Must(t, err)
+
+	r := <-done
+	tu.Must(t, r.err)
+	expected := []PaymentOutcome{
+		{964531182376517632, channelDirection(f.from, f.to), 1000, outcomeSuccess},
+	}
+	if !reflect.DeepEqual(expected, r.outcomes) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r.outcomes)
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/joho/godotenv"
 	"master.private/bstd.git/util"
 )
@@ -12,18 +17,130 @@ type config struct {
 	BtcUrl      string
 	BtcUser     string
 	BtcPassword string
+	// LnBackend is the lightning node implementation: "cln", "lnd" or
+	// "eclair", or "file" to route over a graph dump at LnAddress
+	LnBackend   string
 	LnNetwork   string
 	LnAddress   string
+	LnPoolSize  int64
+	LnMaxRoutes int64
+	// LnTimeout bounds the time spent finding the routes of a request
+	LnTimeout        time.Duration
+	LnPolicyCacheTtl time.Duration
+	// LnPolicyPollInterval is how often the cached channel policies are
+	// checked for newer channel updates, 0 disabling the check
+	LnPolicyPollInterval time.Duration
+	// LnPathfinding is either "node", to ask the lightning node for routes,
+	// or "local", to find routes over the in memory channel graph
+	LnPathfinding string
+	// LnGraphRefresh is how often the channels reported as changed are
+	// fetched again, the whole graph being listed every LnGraphFullRefresh
+	LnGraphRefresh     time.Duration
+	LnGraphFullRefresh time.Duration
+	// LnMppMinShardSat and LnMppMaxParts bound the parts of multi-part
+	// payment splits
+	LnMppMinShardSat int64
+	LnMppMaxParts    int64
+	// LnMissionControlPath is the file persisting the channels success
+	// history learned from payment reports, saved every minute. Empty, the
+	// history is kept in memory only.
+	LnMissionControlPath     string
+	LnMissionControlHalfLife time.Duration
+	// LnRouteCacheTtl is how long found routes are reused, 0 disabling the
+	// route cache
+	LnRouteCacheTtl time.Duration
+	// LnProbeBudget is the number of probes sent every LnProbeInterval to
+	// the most requested destinations, 0 disabling probing
+	LnProbeBudget   int64
+	LnProbeInterval time.Duration
+	// LnFileNodeId is the route source of the file backend when requests
+	// have none
+	LnFileNodeId string
+	// LnBlockedNodes are never recommended as channel peers
+	LnBlockedNodes  []string
+	LndMacaroonPath string
+	LndTlsCertPath  string
+	EclairPassword  string
+	// ReportClientHeader is the header holding the client address set by a
+	// trusted reverse proxy, to tell the reporting clients apart behind it
+	ReportClientHeader string
 }
 
 func init() {
 	godotenv.Load()
 	cfg = config{
-		ListenAddr:  util.EnvOrDefault("LISTEN_ADDR", "0.0.0.0:8088"),
-		BtcUrl:      util.MustEnv("BTC_URL"),
-		BtcUser:     util.MustEnv("BTC_USER"),
-		BtcPassword: util.MustEnv("BTC_PASSWORD"),
-		LnNetwork:   util.MustEnv("LN_NETWORK"),
-		LnAddress:   util.MustEnv("LN_ADDRESS"),
+		ListenAddr:               util.EnvOrDefault("LISTEN_ADDR", "0.0.0.0:8088"),
+		BtcUrl:                   util.MustEnv("BTC_URL"),
+		BtcUser:                  util.MustEnv("BTC_USER"),
+		BtcPassword:              util.MustEnv("BTC_PASSWORD"),
+		LnBackend:                util.EnvOrDefault("LN_BACKEND", "cln"),
+		LnNetwork:                util.EnvOrDefault("LN_NETWORK", "unix"),
+		LnAddress:                util.MustEnv("LN_ADDRESS"),
+		LnPoolSize:               int64EnvOrDefault("LN_POOL_SIZE", 4),
+		LnMaxRoutes:              int64EnvOrDefault("LN_MAX_ROUTES", 3),
+		LnTimeout:                durationEnvOrDefault("LN_TIMEOUT", time.Second*30),
+		LnPolicyCacheTtl:         durationEnvOrDefault("LN_POLICY_CACHE_TTL", time.Minute*10),
+		LnPolicyPollInterval:     durationEnvOrDefault("LN_POLICY_POLL_INTERVAL", time.Minute*5),
+		LnPathfinding:            util.EnvOrDefault("LN_PATHFINDING", "node"),
+		LnGraphRefresh:           durationEnvOrDefault("LN_GRAPH_REFRESH", time.Minute),
+		LnGraphFullRefresh:       durationEnvOrDefault("LN_GRAPH_FULL_REFRESH", time.Hour),
+		LnMppMinShardSat:         int64EnvOrDefault("LN_MPP_MIN_SHARD_SAT", 10_000),
+		LnMppMaxParts:            int64EnvOrDefault("LN_MPP_MAX_PARTS", 8),
+		LnMissionControlPath:     util.EnvOrDefault("LN_MISSION_CONTROL_PATH", ""),
+		LnMissionControlHalfLife: durationEnvOrDefault("LN_MISSION_CONTROL_HALF_LIFE", time.Hour),
+		LnRouteCacheTtl:          durationEnvOrDefault("LN_ROUTE_CACHE_TTL", time.Second*30),
+		LnProbeBudget:            int64EnvOrDefault("LN_PROBE_BUDGET", 0),
+		LnProbeInterval:          durationEnvOrDefault("LN_PROBE_INTERVAL", time.Minute*10),
+		LnFileNodeId:             util.EnvOrDefault("LN_FILE_NODE_ID", ""),
+		LnBlockedNodes:           listEnvOrDefault("LN_BLOCKED_NODES", nil),
+		LndMacaroonPath:          util.EnvOrDefault("LND_MACAROON_PATH", ""),
+		LndTlsCertPath:           util.EnvOrDefault("LND_TLS_CERT_PATH", ""),
+		EclairPassword:           util.EnvOrDefault("ECLAIR_PASSWORD", ""),
+		ReportClientHeader:       util.EnvOrDefault("REPORT_CLIENT_HEADER", ""),
+	}
+	// an empty pool would block every lightning call until its deadline
+	if cfg.LnPoolSize < 1 {
+		panic(fmt.Sprintf("LN_POOL_SIZE must be at least 1, got %d", cfg.LnPoolSize))
+	}
+}
+
+// int64EnvOrDefault returns the environment variable as int64, or the default
+// value when env is undefined
+func int64EnvOrDefault(envKey string, defaultValue int64) int64 {
+	_, ok := os.LookupEnv(envKey)
+	if !ok {
+		return defaultValue
+	}
+	return util.MustInt64Env(envKey)
+}
+
+// listEnvOrDefault returns the comma separated values of the environment
+// variable, or the default value when env is undefined
+func listEnvOrDefault(envKey string, defaultValue []string) []string {
+	v, ok := os.LookupEnv(envKey)
+	if !ok {
+		return defaultValue
+	}
+	var r []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			r = append(r, item)
+		}
+	}
+	return r
+}
+
+// durationEnvOrDefault returns the environment variable parsed as a
+// time.Duration, or the default value when env is undefined
+func durationEnvOrDefault(envKey string, defaultValue time.Duration) time.Duration {
+	v, ok := os.LookupEnv(envKey)
+	if !ok {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		panic(util.ErrWrap("failed to parse env "+envKey, err))
 	}
+	return d
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// eclairRouter finds routes through the HTTP API of an Eclair node
+type eclairRouter struct {
+	c         *http.Client
+	url       string
+	password  string
+	maxRoutes int64
+}
+
+func NewEclairRouter(url, password string, maxRoutes int64) *eclairRouter {
+	return &eclairRouter{
+		c:         &http.Client{Timeout: time.Second * 60},
+		url:       strings.TrimSuffix(url, "/"),
+		password:  password,
+		maxRoutes: maxRoutes,
+	}
+}
+
+func (er *eclairRouter) FindRoutes(
+	ctx context.Context,
+	fromPubkeys []string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) ([]PaymentRoute, error) {
+	sources := fromPubkeys
+	if len(sources) == 0 {
+		// eclair routes from its own node when no source is given
+		sources = []string{""}
+	}
+
+	search := func(
+		ctx context.Context, fromPubkey string, excl RouteExclusions,
+	) (PaymentRoute, error) {
+		return er.findRoute(ctx, fromPubkey, toPubkey, msat, excl, limits)
+	}
+	routes, err := findAlternativeRoutes(
+		ctx, search, sources, msat, excl, limits, er.maxRoutes,
+	)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return routes, nil
+}
+
+func (er *eclairRouter) findRoute(
+	ctx context.Context,
+	fromPubkey, toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) (PaymentRoute, error) {
+	var r struct {
+		Routes []eclairRoute `json:"routes"`
+	}
+	params := url.Values{}
+	params.Set("targetNodeId", strings.ToLower(toPubkey))
+	params.Set("amountMsat", strconv.FormatInt(msat, 10))
+	params.Set("format", "full")
+	if maxFeeMsat := limits.maxFeeMsat(msat); maxFeeMsat > 0 {
+		params.Set("maxFeeMsat", strconv.FormatInt(maxFeeMsat, 10))
+	}
+	// eclair bounds the sum of the hop cltv deltas and the number of hops
+	if limits.MaxCltv > 0 {
+		params.Set("maxCltv", strconv.FormatInt(limits.MaxCltv, 10))
+	}
+	if limits.MaxHops > 0 {
+		params.Set("maxLength", strconv.FormatInt(limits.MaxHops, 10))
+	}
+	if len(excl.Nodes) > 0 {
+		params.Set("ignoreNodeIds", strings.ToLower(strings.Join(excl.Nodes, ",")))
+	}
+	if len(excl.Chans) > 0 {
+		scids := make([]string, 0, len(excl.Chans))
+		for _, v := range excl.Chans {
+			scids = append(scids, shortChannelIdToString(v))
+		}
+		params.Set("ignoreShortChannelIds", strings.Join(scids, ","))
+	}
+
+	method := "findroutetonode"
+	if fromPubkey != "" {
+		method = "findroutebetweennodes"
+		params.Set("sourceNodeId", strings.ToLower(fromPubkey))
+	}
+	err := er.call(ctx, method, params, &r)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	if len(r.Routes) == 0 {
+		return nil, stackerr.Wrap(fmt.Errorf("eclair returned no routes"))
+	}
+
+	// the full format carries the channel update of each hop, so no further
+	// channel lookup is needed
+	route := r.Routes[0]
+	for _, hop := range route.Hops {
+		if hop.Source.ChannelUpdate == nil {
+			return nil, stackerr.Wrap(
+				fmt.Errorf("eclair hop without channel update: %s", hop.NodeId),
+			)
+		}
+	}
+
+	paymentRoute, err := eclairDataToPaymentRoute(route)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return paymentRoute, nil
+}
+
+func (er *eclairRouter) call(
+	ctx context.Context, method string, params url.Values, result interface{},
+) error {
+	req, err := http.NewRequestWithContext(
+		ctx, "POST", er.url+"/"+method, strings.NewReader(params.Encode()),
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("", er.password)
+
+	res, err := er.c.Do(req)
+	if err != nil {
+		return stackerr.Wrap(fmt.Errorf("%w: %w", errLnUnavailable, err))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		var eclairErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&eclairErr)
+		return stackerr.Wrap(fmt.Errorf(
+			"invalid status calling eclair %s: %d: %s",
+			method, res.StatusCode, eclairErr.Error,
+		))
+	}
+	err = json.NewDecoder(res.Body).Decode(result)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func eclairDataToPaymentRoute(route eclairRoute) (PaymentRoute, error) {
+	hops := []Hop{}
+	for _, eclairHop := range route.Hops {
+		update := eclairHop.Source.ChannelUpdate
+		scid, err := shortChannelIdToInt(update.ShortChannelId)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		hops = append(hops, Hop{
+			NodeId:                    strings.ToLower(eclairHop.NodeId),
+			ShortChannelId:            scid,
+			CltvExpiryDelta:           int16(update.CltvExpiryDelta),
+			HtlcMinimumMsat:           update.HtlcMinimumMsat,
+			FeeBaseMsat:               int32(update.FeeBaseMsat),
+			FeeProportionalMillionths: int32(update.FeeProportionalMillionths),
+			HtlcMaximumMsat:           update.HtlcMaximumMsat,
+			Disabled:                  !update.ChannelFlags.IsEnabled,
+		})
+	}
+	return hops, nil
+}
+
+type eclairRoute struct {
+	Amount int64       `json:"amount"`
+	Hops   []eclairHop `json:"hops"`
+}
+
+type eclairHop struct {
+	NodeId     string `json:"nodeId"`
+	NextNodeId string `json:"nextNodeId"`
+	Source     struct {
+		Type          string               `json:"type"`
+		ChannelUpdate *eclairChannelUpdate `json:"channelUpdate"`
+	} `json:"source"`
+}
+
+type eclairChannelUpdate struct {
+	ShortChannelId string `json:"shortChannelId"`
+	Timestamp      struct {
+		Unix int64 `json:"unix"`
+	} `json:"timestamp"`
+	ChannelFlags struct {
+		IsEnabled bool `json:"isEnabled"`
+		IsNode1   bool `json:"isNode1"`
+	} `json:"channelFlags"`
+	CltvExpiryDelta           int32 `json:"cltvExpiryDelta"`
+	HtlcMinimumMsat           int64 `json:"htlcMinimumMsat"`
+	FeeBaseMsat               int64 `json:"feeBaseMsat"`
+	FeeProportionalMillionths int64 `json:"feeProportionalMillionths"`
+	HtlcMaximumMsat           int64 `json:"htlcMaximumMsat"`
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_eclairDataToPaymentRoute(t *testing.T) {
+	routePayload := `{
+		"amount": 1000000,
+		"hops": [
+			{
+				"nodeId": "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+				"nextNodeId": "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+				"source": {
+					"type": "announcement",
+					"channelUpdate": {
+						"shortChannelId": "877236x1112x0",
+						"timestamp": {"iso": "2023-11-14T22:13:20Z", "unix": 1700000000},
+						"channelFlags": {"isEnabled": true, "isNode1": true},
+						"cltvExpiryDelta": 34,
+						"htlcMinimumMsat": 1,
+						"feeBaseMsat": 0,
+						"feeProportionalMillionths": 450,
+						"htlcMaximumMsat": 6930000000
+					}
+				}
+			},
+			{
+				"nodeId": "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+				"nextNodeId": "03dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd",
+				"source": {
+					"type": "announcement",
+					"channelUpdate": {
+						"shortChannelId": "877236x1113x0",
+						"timestamp": {"iso": "2023-11-14T22:13:20Z", "unix": 1700000000},
+						"channelFlags": {"isEnabled": true, "isNode1": true},
+						"cltvExpiryDelta": 210,
+						"htlcMinimumMsat": 1000,
+						"feeBaseMsat": 0,
+						"feeProportionalMillionths": 3000,
+						"htlcMaximumMsat": 8117000
+					}
+				}
+			}
+		]
+	}`
+
+	var route eclairRoute
+	tu.Must(t, json.Unmarshal([]byte(routePayload), &route))
+
+	expected := PaymentRoute{
+		{
+			NodeId:                    "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			ShortChannelId:            964531182376583168,
+			CltvExpiryDelta:           34,
+			HtlcMinimumMsat:           1,
+			FeeBaseMsat:               0,
+			FeeProportionalMillionths: 450,
+			HtlcMaximumMsat:           6930000000,
+		},
+		{
+			NodeId:                    "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+			ShortChannelId:            964531182376648704,
+			CltvExpiryDelta:           210,
+			HtlcMinimumMsat:           1000,
+			FeeBaseMsat:               0,
+			FeeProportionalMillionths: 3000,
+			HtlcMaximumMsat:           8117000,
+		},
+	}
+
+	r, err := eclairDataToPaymentRoute(route)
+	tu.Must(t, err)
+
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	route.Hops[1].Source.ChannelUpdate.ShortChannelId = "877236x1113"
+	if _, err := eclairDataToPaymentRoute(route); err == nil {
+		t.Fatal("expecting an error for the malformed short channel id")
+	}
+}
+
+func Test_eclairRouterFindRoute(t *testing.T) {
+	var params url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tu.Must(t, r.ParseForm())
+		params = r.PostForm
+		w.Write([]byte(`{"routes":[{"amount":1000,"hops":[{"nodeId":"02AA","source":{"channelUpdate":{"shortChannelId":"1x2x3"}}}]}]}`))
+	}))
+	defer ts.Close()
+
+	er := NewEclairRouter(ts.URL, "", 1)
+	limits := RouteLimits{MaxFeeMsat: 10, MaxCltv: 144, MaxHops: 3}
+	r, err := er.findRoute(context.Background(), "", "02bb", 1000, RouteExclusions{}, limits)
+	tu.Must(t, err)
+	if len(r) != 1 || r[0].ShortChannelId != mustShortChannelIdToInt("1x2x3") {
+		t.Fatalf("unexpected: %+v", r)
+	}
+	expected := map[string]string{"maxFeeMsat": "10", "maxCltv": "144", "maxLength": "3"}
+	for k, v := range expected {
+		if params.Get(k) != v {
+			t.Fatalf("expecting: %+v\ngot: %+v\n", v, params.Get(k))
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// channelGraph is the in memory view of the public channel graph. Each
+// channel is stored as two directed edges, each with the policy of its
+// source node.
+type channelGraph struct {
+	mu        sync.RWMutex
+	nodes     map[string]graphNode
+	edges     map[edgeKey]*graphEdge
+	in        map[string]map[edgeKey]*graphEdge
+	updatedAt time.Time
+}
+
+type edgeKey struct {
+	ShortChannelId int64
+	Direction      int
+}
+
+type graphEdge struct {
+	ShortChannelId            int64
+	Source                    string
+	Destination               string
+	CapacityMsat              int64
+	CltvExpiryDelta           int16
+	HtlcMinimumMsat           int64
+	HtlcMaximumMsat           int64
+	FeeBaseMsat               int32
+	FeeProportionalMillionths int32
+	Disabled                  bool
+	LastUpdate                int64
+	Features                  string
+	// DisableToggles counts the updates switching the edge between enabled
+	// and disabled seen since the process started, it is not persisted
+	DisableToggles int64
+}
+
+type graphNode struct {
+	Id         string
+	Alias      string
+	LastUpdate int64
+}
+
+func newChannelGraph() *channelGraph {
+	return &channelGraph{
+		nodes: map[string]graphNode{},
+		edges: map[edgeKey]*graphEdge{},
+		in:    map[string]map[edgeKey]*graphEdge{},
+	}
+}
+
+// channelDirection is 0 when source is the lexicographically lesser node
+// of the channel, 1 otherwise
+func channelDirection(source, destination string) int {
+	if strings.ToLower(source) < strings.ToLower(destination) {
+		return 0
+	}
+	return 1
+}
+
+// applyChannels updates the graph with the listed channels. Edges with an
+// unchanged update timestamp are kept and edges absent from the list are
+// removed.
+func (g *channelGraph) applyChannels(chans []clnChan) (nUpdated, nRemoved int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	seen := make(map[edgeKey]struct{}, len(chans))
+	for _, c := range chans {
+		key, updated := g.putEdge(clnChanToEdge(c))
+		seen[key] = struct{}{}
+		if updated {
+			nUpdated++
+		}
+	}
+	for key := range g.edges {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		g.removeEdge(key)
+		nRemoved++
+	}
+	g.updatedAt = time.Now()
+	return nUpdated, nRemoved
+}
+
+// applyChannelUpdate replaces the edges of a single channel with the listed
+// ones, the channel being removed when none are listed
+func (g *channelGraph) applyChannelUpdate(scid int64, chans []clnChan) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	seen := map[edgeKey]struct{}{}
+	for _, c := range chans {
+		key, _ := g.putEdge(clnChanToEdge(c))
+		seen[key] = struct{}{}
+	}
+	for direction := range 2 {
+		key := edgeKey{scid, direction}
+		if _, ok := seen[key]; !ok {
+			g.removeEdge(key)
+		}
+	}
+}
+
+// putEdge stores the edge unless its update timestamp is unchanged, keeping
+// the count of its disable toggles. The caller holds the write lock.
+func (g *channelGraph) putEdge(edge *graphEdge) (key edgeKey, updated bool) {
+	key = edgeKey{
+		edge.ShortChannelId,
+		channelDirection(edge.Source, edge.Destination),
+	}
+	if old, ok := g.edges[key]; ok {
+		if old.LastUpdate == edge.LastUpdate {
+			return key, false
+		}
+		edge.DisableToggles = old.DisableToggles
+		if old.Disabled != edge.Disabled {
+			edge.DisableToggles++
+		}
+	}
+	g.edges[key] = edge
+	if _, ok := g.in[edge.Destination]; !ok {
+		g.in[edge.Destination] = map[edgeKey]*graphEdge{}
+	}
+	g.in[edge.Destination][key] = edge
+	return key, true
+}
+
+// removeEdge drops the edge if present. The caller holds the write lock.
+func (g *channelGraph) removeEdge(key edgeKey) {
+	edge, ok := g.edges[key]
+	if !ok {
+		return
+	}
+	delete(g.edges, key)
+	delete(g.in[edge.Destination], key)
+	if len(g.in[edge.Destination]) == 0 {
+		delete(g.in, edge.Destination)
+	}
+}
+
+func (g *channelGraph) applyNodes(nodes []clnNode) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.nodes = make(map[string]graphNode, len(nodes))
+	for _, n := range nodes {
+		id := strings.ToLower(n.NodeId)
+		g.nodes[id] = graphNode{
+			Id:         id,
+			Alias:      n.Alias,
+			LastUpdate: n.LastTimestamp,
+		}
+	}
+}
+
+func (g *channelGraph) isEmpty() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.edges) == 0
+}
+
+// inboundHops returns the edges ending at the node as hops
+func (g *channelGraph) inboundHops(nodeId string) []Hop {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	in := g.in[strings.ToLower(nodeId)]
+	r := make([]Hop, 0, len(in))
+	for _, edge := range in {
+		r = append(r, edge.toHop())
+	}
+	return r
+}
+
+func clnChanToEdge(c clnChan) *graphEdge {
+	return &graphEdge{
+		ShortChannelId:            mustShortChannelIdToInt(c.ShortChannelId),
+		Source:                    strings.ToLower(c.Source),
+		Destination:               strings.ToLower(c.Destination),
+		CapacityMsat:              int64(c.AmountMsat),
+		CltvExpiryDelta:           int16(c.Delay),
+		HtlcMinimumMsat:           int64(c.HtlcMinMsat),
+		HtlcMaximumMsat:           int64(c.HtlcMaxMsat),
+		FeeBaseMsat:               int32(c.BaseFeeMsat),
+		FeeProportionalMillionths: int32(c.FeePerMillionth),
+		Disabled:                  !c.Active,
+		LastUpdate:                c.LastUpdate,
+		Features:                  c.Features,
+	}
+}
+
+func (e *graphEdge) toHop() Hop {
+	return Hop{
+		NodeId:                    e.Source,
+		ShortChannelId:            e.ShortChannelId,
+		CltvExpiryDelta:           e.CltvExpiryDelta,
+		HtlcMinimumMsat:           e.HtlcMinimumMsat,
+		FeeBaseMsat:               e.FeeBaseMsat,
+		FeeProportionalMillionths: e.FeeProportionalMillionths,
+		HtlcMaximumMsat:           e.HtlcMaximumMsat,
+		Disabled:                  e.Disabled,
+		Features:                  e.Features,
+	}
+}
+
+// findRoute runs a dijkstra search from the destination back to the source,
+// so the amount forwarded through each edge, and therefore its fee, is known
+// when the edge is relaxed. The cost of an edge is its fee plus the risk of
+// having the forwarded amount locked by its cltv delta. The search fails with
+// errNoRouteWithinBudget when it dropped edges only because of the limits.
+func (g *channelGraph) findRoute(
+	fromPubkey, toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	maxHops int64,
+	limits RouteLimits,
+	cltvRiskPpm int64,
+) (PaymentRoute, error) {
+	type label struct {
+		amount int64
+		cost   int64
+		cltv   int64
+		hops   int64
+		next   *graphEdge
+	}
+
+	fromPubkey = strings.ToLower(fromPubkey)
+	toPubkey = strings.ToLower(toPubkey)
+	if fromPubkey == toPubkey {
+		return nil, stackerr.Wrap(fmt.Errorf("source is the destination"))
+	}
+	bannedNodes := make(map[string]struct{}, len(excl.Nodes))
+	for _, v := range excl.Nodes {
+		bannedNodes[strings.ToLower(v)] = struct{}{}
+	}
+	bannedChans := make(map[int64]struct{}, len(excl.Chans))
+	for _, v := range excl.Chans {
+		bannedChans[v] = struct{}{}
+	}
+
+	maxFee := limits.maxFeeMsat(msat)
+	// set when an edge is dropped only because of the limits
+	budgetPruned := false
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	labels := map[string]label{toPubkey: {amount: msat}}
+	pq := &nodeHeap{{toPubkey, 0}}
+	for pq.Len() > 0 {
+		item := heap.Pop(pq).(nodeHeapItem)
+		current := labels[item.nodeId]
+		if item.cost > current.cost {
+			continue
+		}
+		if item.nodeId == fromPubkey {
+			break
+		}
+		if current.hops >= maxHops {
+			continue
+		}
+		if limits.MaxHops > 0 && current.hops >= limits.MaxHops {
+			budgetPruned = budgetPruned || len(g.in[item.nodeId]) > 0
+			continue
+		}
+		for _, e := range g.in[item.nodeId] {
+			if _, ok := bannedNodes[e.Source]; ok {
+				continue
+			}
+			if _, ok := bannedChans[e.ShortChannelId]; ok {
+				continue
+			}
+			amount := current.amount
+			if e.Disabled ||
+				amount < e.HtlcMinimumMsat ||
+				(e.HtlcMaximumMsat > 0 && amount > e.HtlcMaximumMsat) ||
+				(e.CapacityMsat > 0 && amount > e.CapacityMsat) {
+				continue
+			}
+			fee := hopFeeMsat(e.toHop(), amount)
+			// the partial routes beyond a budget can only grow past it
+			if maxFee > 0 && amount+fee-msat > maxFee {
+				budgetPruned = true
+				continue
+			}
+			cltv := current.cltv + int64(e.CltvExpiryDelta)
+			if limits.MaxCltv > 0 && cltv > limits.MaxCltv {
+				budgetPruned = true
+				continue
+			}
+			risk := amount * int64(e.CltvExpiryDelta) * cltvRiskPpm / 1_000_000
+			cost := current.cost + fee + risk
+			if old, ok := labels[e.Source]; ok && old.cost <= cost {
+				continue
+			}
+			labels[e.Source] = label{
+				amount: amount + fee,
+				cost:   cost,
+				cltv:   cltv,
+				hops:   current.hops + 1,
+				next:   e,
+			}
+			heap.Push(pq, nodeHeapItem{e.Source, cost})
+		}
+	}
+
+	if _, ok := labels[fromPubkey]; !ok {
+		if budgetPruned {
+			return nil, stackerr.Wrap(fmt.Errorf(
+				"%w from %s to %s", errNoRouteWithinBudget, fromPubkey, toPubkey,
+			))
+		}
+		return nil, stackerr.Wrap(
+			fmt.Errorf("no route from %s to %s", fromPubkey, toPubkey),
+		)
+	}
+	var route PaymentRoute
+	for node := fromPubkey; node != toPubkey; {
+		e := labels[node].next
+		route = append(route, e.toHop())
+		node = e.Destination
+	}
+	return route, nil
+}
+
+type nodeHeapItem struct {
+	nodeId string
+	cost   int64
+}
+
+type nodeHeap []nodeHeapItem
+
+func (h nodeHeap) Len() int           { return len(h) }
+func (h nodeHeap) Less(i, j int) bool { return h[i].cost < h[j].cost }
+func (h nodeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *nodeHeap) Push(x any) {
+	*h = append(*h, x.(nodeHeapItem))
+}
+
+func (h *nodeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
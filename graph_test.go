@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_channelGraphFindRoute(t *testing.T) {
+	const (
+		a = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		b = "02bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+		c = "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+		d = "03dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd"
+	)
+	newChan := func(source, destination, scid string, feeBase int64) clnChan {
+		return clnChan{
+			Source:          source,
+			Destination:     destination,
+			ShortChannelId:  scid,
+			BaseFeeMsat:     feeBase,
+			FeePerMillionth: 100,
+			Delay:           40,
+			HtlcMinMsat:     1,
+			HtlcMaxMsat:     1000000000,
+			AmountMsat:      1000000000,
+			Active:          true,
+			LastUpdate:      1700000000,
+		}
+	}
+	limits := RouteLimits{}
+	g := newChannelGraph()
+	nUpdated, _ := g.applyChannels([]clnChan{
+		newChan(a, b, "877236x1111x0", 1000),
+		newChan(b, d, "877236x1112x0", 1000),
+		newChan(a, c, "877236x1113x0", 2000),
+		newChan(c, d, "877236x1114x0", 2000),
+	})
+	if nUpdated != 4 {
+		t.Fatal("unexpected updated edges:", nUpdated)
+	}
+
+	r, err := g.findRoute(a, d, 1_000_000, RouteExclusions{}, 20, limits, 10)
+	tu.Must(t, err)
+	expected := PaymentRoute{
+		{
+			NodeId:                    a,
+			ShortChannelId:            mustShortChannelIdToInt("877236x1111x0"),
+			CltvExpiryDelta:           40,
+			HtlcMinimumMsat:           1,
+			FeeBaseMsat:               1000,
+			FeeProportionalMillionths: 100,
+			HtlcMaximumMsat:           1000000000,
+		},
+		{
+			NodeId:                    b,
+			ShortChannelId:            mustShortChannelIdToInt("877236x1112x0"),
+			CltvExpiryDelta:           40,
+			HtlcMinimumMsat:           1,
+			FeeBaseMsat:               1000,
+			FeeProportionalMillionths: 100,
+			HtlcMaximumMsat:           1000000000,
+		},
+	}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	r, err = g.findRoute(a, d, 1_000_000, RouteExclusions{Nodes: []string{b}}, 20, limits, 10)
+	tu.Must(t, err)
+	if len(r) != 2 || r[0].NodeId != a || r[1].NodeId != c {
+		t.Fatalf("unexpected: %+v", r)
+	}
+
+	_, err = g.findRoute(a, d, 1_000_000, RouteExclusions{Nodes: []string{b, c}}, 20, limits, 10)
+	if err == nil || errors.Is(err, errNoRouteWithinBudget) {
+		t.Fatal("expecting no route, got:", err)
+	}
+
+	// the routes above the budgets are not searched
+	budget := RouteLimits{MaxFeeMsat: 3000}
+	_, err = g.findRoute(a, d, 1_000_000, RouteExclusions{}, 20, budget, 10)
+	tu.Must(t, err)
+	_, err = g.findRoute(a, d, 1_000_000, RouteExclusions{Nodes: []string{b}}, 20, budget, 10)
+	if !errors.Is(err, errNoRouteWithinBudget) {
+		t.Fatal("expecting no route within the fee budget, got:", err)
+	}
+	budget = RouteLimits{MaxCltv: 79}
+	_, err = g.findRoute(a, d, 1_000_000, RouteExclusions{}, 20, budget, 10)
+	if !errors.Is(err, errNoRouteWithinBudget) {
+		t.Fatal("expecting no route within the cltv budget, got:", err)
+	}
+	budget = RouteLimits{MaxHops: 1}
+	_, err = g.findRoute(a, d, 1_000_000, RouteExclusions{}, 20, budget, 10)
+	if !errors.Is(err, errNoRouteWithinBudget) {
+		t.Fatal("expecting no route within the hops budget, got:", err)
+	}
+	_, err = g.findRoute(a, d, 1_000_000, RouteExclusions{}, 1, limits, 10)
+	if err == nil || errors.Is(err, errNoRouteWithinBudget) {
+		t.Fatal("expecting no route, got:", err)
+	}
+
+	// removed edges must not be used anymore
+	_, nRemoved := g.applyChannels([]clnChan{
+		newChan(a, c, "877236x1113x0", 2000),
+		newChan(c, d, "877236x1114x0", 2000),
+	})
+	if nRemoved != 2 {
+		t.Fatal("unexpected removed edges:", nRemoved)
+	}
+	r, err = g.findRoute(a, d, 1_000_000, RouteExclusions{}, 20, limits, 10)
+	tu.Must(t, err)
+	if !reflect.DeepEqual([]string{r[0].NodeId, r[1].NodeId}, []string{a, c}) {
+		t.Fatalf("unexpected: %+v", r)
+	}
+}
+
+// memGraphSource serves its channels, counting the full listings
+type memGraphSource struct {
+	mu     sync.Mutex
+	chans  []clnChan
+	nLists int
+}
+
+func (m *memGraphSource) getNodeId(_ context.Context) (string, error) {
+	return "", nil
+}
+
+func (m *memGraphSource) listChannels(_ context.Context) ([]clnChan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nLists++
+	return append([]clnChan(nil), m.chans...), nil
+}
+
+func (m *memGraphSource) listNodes(_ context.Context) ([]clnNode, error) {
+	return nil, nil
+}
+
+func (m *memGraphSource) listChannel(_ context.Context, scid int64) ([]clnChan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var r []clnChan
+	for _, c := range m.chans {
+		if mustShortChannelIdToInt(c.ShortChannelId) == scid {
+			r = append(r, c)
+		}
+	}
+	return r, nil
+}
+
+func Test_graphRouterRefresh(t *testing.T) {
+	const (
+		a = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		b = "02bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	)
+	newChan := func(scid string, feeBase, lastUpdate int64) clnChan {
+		return clnChan{
+			Source:         a,
+			Destination:    b,
+			ShortChannelId: scid,
+			BaseFeeMsat:    feeBase,
+			Active:         true,
+			LastUpdate:     lastUpdate,
+		}
+	}
+	source := &memGraphSource{chans: []clnChan{
+		newChan("1x1x0", 1000, 1),
+		newChan("1x2x0", 1000, 1),
+	}}
+	gr := NewGraphRouter(source, 3, time.Hour, time.Hour)
+	gr.Close()
+
+	ctx := context.Background()
+	tu.Must(t, gr.refresh(ctx))
+	feeBases := func() []int32 {
+		var r []int32
+		for _, scid := range []string{"1x1x0", "1x2x0"} {
+			for _, e := range gr.graph.channelEdges(mustShortChannelIdToInt(scid)) {
+				r = append(r, e.FeeBaseMsat)
+			}
+		}
+		return r
+	}
+
+	// both channels change, only the invalidated one is fetched before the
+	// next full refresh, and a closed channel is removed
+	source.mu.Lock()
+	source.chans = []clnChan{newChan("1x2x0", 3000, 2)}
+	source.mu.Unlock()
+	gr.invalidatePolicy(mustShortChannelIdToInt("1x1x0"))
+	tu.Must(t, gr.refresh(ctx))
+	expected := []int32{1000}
+	if !reflect.DeepEqual(expected, feeBases()) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, feeBases())
+	}
+
+	gr.mu.Lock()
+	gr.lastFullRefresh = time.Time{}
+	gr.mu.Unlock()
+	tu.Must(t, gr.refresh(ctx))
+	expected = []int32{3000}
+	if !reflect.DeepEqual(expected, feeBases()) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, feeBases())
+	}
+}
+
+func Test_graphRouterFindRoutes(t *testing.T) {
+	const (
+		a = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		b = "02bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+		c = "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+	)
+	newChan := func(source, destination, scid string) clnChan {
+		return clnChan{
+			Source:         source,
+			Destination:    destination,
+			ShortChannelId: scid,
+			BaseFeeMsat:    5000,
+			Delay:          40,
+			HtlcMaxMsat:    1000000000,
+			Active:         true,
+			LastUpdate:     1,
+		}
+	}
+	source := &memGraphSource{chans: []clnChan{
+		newChan(a, b, "1x1x0"),
+		newChan(b, c, "1x2x0"),
+	}}
+	gr := NewGraphRouter(source, 3, time.Hour, time.Hour)
+	gr.Close()
+	ctx := context.Background()
+	tu.Must(t, gr.refresh(ctx))
+
+	routes, err := gr.FindRoutes(ctx, []string{a}, c, 1_000_000, RouteExclusions{}, RouteLimits{})
+	tu.Must(t, err)
+	if len(routes) != 1 {
+		t.Fatalf("unexpected: %+v", routes)
+	}
+	// a route over the budget is reported as such, not as a missing route
+	for i, limits := range []RouteLimits{{MaxFeeMsat: 4999}, {MaxCltv: 39}, {MaxHops: 1}} {
+		_, err := gr.FindRoutes(ctx, []string{a}, c, 1_000_000, RouteExclusions{}, limits)
+		if !errors.Is(err, errNoRouteWithinBudget) {
+			t.Fatalf("%d: expecting: %+v\ngot: %+v\n", i, errNoRouteWithinBudget, err)
+		}
+	}
+}
+
+func Test_graphRouterClose(t *testing.T) {
+	source := &memGraphSource{}
+	gr := NewGraphRouter(source, 3, time.Millisecond, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	tu.Must(t, gr.Close())
+	time.Sleep(10 * time.Millisecond)
+
+	source.mu.Lock()
+	nLists := source.nLists
+	source.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if source.nLists != nLists {
+		t.Fatalf("refreshing after close: %d lists, then %d", nLists, source.nLists)
+	}
+}
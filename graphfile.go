@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// fileGraphSource reads the channel graph from a json dump, either the CLN
+// listchannels and listnodes outputs merged in a single object, or the LND
+// describegraph output. The file is read again on each graph refresh.
+type fileGraphSource struct {
+	path   string
+	nodeId string
+}
+
+// NewFileRouter finds routes over the graph of the file, from nodeId when
+// the request has no sources. The file is read again every refresh
+// interval.
+func NewFileRouter(
+	path, nodeId string, maxRoutes int64, refreshInterval time.Duration,
+) *graphRouter {
+	source := &fileGraphSource{path: path, nodeId: nodeId}
+	_, _, err := source.read()
+	if err != nil {
+		panic(stackerr.Wrap(err))
+	}
+	return NewGraphRouter(source, maxRoutes, refreshInterval, refreshInterval)
+}
+
+func (fs *fileGraphSource) getNodeId(_ context.Context) (string, error) {
+	if fs.nodeId == "" {
+		return "", stackerr.Wrap(fmt.Errorf("no source node for the graph file"))
+	}
+	return fs.nodeId, nil
+}
+
+func (fs *fileGraphSource) listChannels(_ context.Context) ([]clnChan, error) {
+	chans, _, err := fs.read()
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return chans, nil
+}
+
+func (fs *fileGraphSource) listNodes(_ context.Context) ([]clnNode, error) {
+	_, nodes, err := fs.read()
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return nodes, nil
+}
+
+func (fs *fileGraphSource) read() ([]clnChan, []clnNode, error) {
+	b, err := os.ReadFile(fs.path)
+	if err != nil {
+		return nil, nil, stackerr.Wrap(err)
+	}
+	chans, nodes, err := decodeGraphDump(b)
+	if err != nil {
+		return nil, nil, stackerr.Wrap(err)
+	}
+	return chans, nodes, nil
+}
+
+// decodeGraphDump decodes a CLN or LND graph dump, LND edges being converted
+// to a CLN channel per direction with a policy
+func decodeGraphDump(b []byte) ([]clnChan, []clnNode, error) {
+	var dump struct {
+		// CLN
+		Channels []clnChan `json:"channels"`
+		// LND
+		Edges []lndEdge `json:"edges"`
+		// both, with their own field names
+		Nodes []struct {
+			NodeId        string `json:"nodeid"`
+			PubKey        string `json:"pub_key"`
+			Alias         string `json:"alias"`
+			LastTimestamp int64  `json:"last_timestamp"`
+			LastUpdate    int64  `json:"last_update"`
+		} `json:"nodes"`
+	}
+	err := json.Unmarshal(b, &dump)
+	if err != nil {
+		return nil, nil, stackerr.Wrap(err)
+	}
+	if len(dump.Channels) == 0 && len(dump.Edges) == 0 {
+		return nil, nil, stackerr.Wrap(fmt.Errorf("graph dump without channels"))
+	}
+
+	chans := dump.Channels
+	for _, e := range dump.Edges {
+		policies := []struct {
+			source, destination string
+			policy              lndRoutingPolicy
+		}{
+			{e.Node1Pub, e.Node2Pub, e.Node1Policy},
+			{e.Node2Pub, e.Node1Pub, e.Node2Policy},
+		}
+		for _, v := range policies {
+			// a direction without channel update has no policy
+			if v.policy == (lndRoutingPolicy{}) {
+				continue
+			}
+			chans = append(chans, clnChan{
+				Source:          v.source,
+				Destination:     v.destination,
+				ShortChannelId:  shortChannelIdToString(e.ChannelId),
+				BaseFeeMsat:     v.policy.FeeBaseMsat,
+				FeePerMillionth: v.policy.FeeRateMilliMsat,
+				Delay:           v.policy.TimeLockDelta,
+				HtlcMinMsat:     clnMsat(v.policy.MinHtlc),
+				HtlcMaxMsat:     clnMsat(v.policy.MaxHtlcMsat),
+				AmountMsat:      clnMsat(e.Capacity * 1000),
+				Active:          !v.policy.Disabled,
+				LastUpdate:      v.policy.LastUpdate,
+			})
+		}
+	}
+
+	// the dump is not trusted to be well formed, unlike the node outputs
+	for _, c := range chans {
+		err := validateClnChan(c)
+		if err != nil {
+			return nil, nil, stackerr.Wrap(err)
+		}
+	}
+
+	nodes := make([]clnNode, 0, len(dump.Nodes))
+	for _, v := range dump.Nodes {
+		node := clnNode{v.NodeId, v.Alias, v.LastTimestamp}
+		if node.NodeId == "" {
+			node = clnNode{v.PubKey, v.Alias, v.LastUpdate}
+		}
+		nodes = append(nodes, node)
+	}
+	return chans, nodes, nil
+}
+
+// validateClnChan checks the fields of the channel decoded when serving its
+// routes
+func validateClnChan(c clnChan) error {
+	_, err := shortChannelIdToInt(c.ShortChannelId)
+	if err != nil {
+		return fmt.Errorf("invalid short channel id %q: %w", c.ShortChannelId, err)
+	}
+	for _, nodeId := range []string{c.Source, c.Destination} {
+		b, err := hex.DecodeString(nodeId)
+		if err != nil || len(b) != 33 {
+			return fmt.Errorf("invalid node id %q of channel %s", nodeId, c.ShortChannelId)
+		}
+	}
+	_, err = hex.DecodeString(c.Features)
+	if err != nil {
+		return fmt.Errorf("invalid features %q of channel %s", c.Features, c.ShortChannelId)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_decodeGraphDump(t *testing.T) {
+	const (
+		a = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		b = "02bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	)
+	// lnd describegraph, the second direction without policy
+	dump := `{
+		"nodes": [{"pub_key": "` + a + `", "alias": "A", "last_update": 1700000000}],
+		"edges": [{
+			"channel_id": "964531182376517632",
+			"node1_pub": "` + a + `",
+			"node2_pub": "` + b + `",
+			"capacity": "1000000",
+			"node1_policy": {
+				"time_lock_delta": 40,
+				"min_htlc": "1000",
+				"fee_base_msat": "1000",
+				"fee_rate_milli_msat": "100",
+				"disabled": false,
+				"max_htlc_msat": "990000000",
+				"last_update": 1700000000
+			},
+			"node2_policy": null
+		}]
+	}`
+	chans, nodes, err := decodeGraphDump([]byte(dump))
+	tu.Must(t, err)
+
+	expectedChans := []clnChan{{
+		Source:          a,
+		Destination:     b,
+		ShortChannelId:  "877236x1111x0",
+		BaseFeeMsat:     1000,
+		FeePerMillionth: 100,
+		Delay:           40,
+		HtlcMinMsat:     1000,
+		HtlcMaxMsat:     990000000,
+		AmountMsat:      1000000000,
+		Active:          true,
+		LastUpdate:      1700000000,
+	}}
+	if !reflect.DeepEqual(expectedChans, chans) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expectedChans, chans)
+	}
+	expectedNodes := []clnNode{{a, "A", 1700000000}}
+	if !reflect.DeepEqual(expectedNodes, nodes) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expectedNodes, nodes)
+	}
+
+	// malformed channels are rejected, not to fail serving their routes
+	for _, c := range []string{
+		`{"source": "` + a + `", "destination": "` + b + `", "short_channel_id": "877236x1111x0", "features": "zz"}`,
+		`{"source": "02aa", "destination": "` + b + `", "short_channel_id": "877236x1111x0"}`,
+		`{"source": "` + a + `", "destination": "` + b + `", "short_channel_id": "877236:1111:0"}`,
+	} {
+		_, _, err = decodeGraphDump([]byte(`{"channels": [` + c + `]}`))
+		if err == nil {
+			t.Fatal("expecting an error for", c)
+		}
+	}
+}
+
+func Test_fileRouter(t *testing.T) {
+	const (
+		a = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		b = "02bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	)
+	// cln listchannels and listnodes merged
+	dump := `{
+		"channels": [{
+			"source": "` + a + `",
+			"destination": "` + b + `",
+			"short_channel_id": "877236x1111x0",
+			"base_fee_millisatoshi": 1000,
+			"fee_per_millionth": 100,
+			"delay": 40,
+			"htlc_minimum_msat": 1,
+			"htlc_maximum_msat": 1000000000,
+			"amount_msat": 1000000000,
+			"active": true,
+			"last_update": 1700000000
+		}],
+		"nodes": [{"nodeid": "` + a + `", "alias": "A", "last_timestamp": 1700000000}]
+	}`
+	path := filepath.Join(t.TempDir(), "graph.json")
+	tu.Must(t, os.WriteFile(path, []byte(dump), 0o600))
+
+	ctx := context.Background()
+	gr := NewFileRouter(path, a, 3, time.Hour)
+	defer gr.Close()
+	tu.Must(t, gr.refresh(ctx))
+
+	r, err := gr.FindRoutes(ctx, nil, b, 100_000, RouteExclusions{}, RouteLimits{})
+	tu.Must(t, err)
+	if len(r) != 1 || r[0][0].NodeId != a || r[0][0].ShortChannelId != 964531182376517632 {
+		t.Fatalf("unexpected routes: %+v", r)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// graphSource provides the channel graph data used by the graphRouter
+type graphSource interface {
+	getNodeId(ctx context.Context) (string, error)
+	listChannels(ctx context.Context) ([]clnChan, error)
+	listNodes(ctx context.Context) ([]clnNode, error)
+}
+
+// channelFetcher is implemented by the graph sources able to list the
+// directions of a single channel, none when it is closed
+type channelFetcher interface {
+	listChannel(ctx context.Context, scid int64) ([]clnChan, error)
+}
+
+// graphRouter finds routes locally over the channel graph, refreshed in
+// background from the graph source. The whole graph is listed every full
+// refresh interval, and in between only the channels known to have changed
+// are fetched again. Those are the channels invalidated by payment reports:
+// the other channel updates, and the opened and closed channels, are only
+// seen on the next full refresh.
+type graphRouter struct {
+	graph               *channelGraph
+	source              graphSource
+	maxRoutes           int64
+	maxHops             int
+	cltvRiskPpm         int64
+	fullRefreshInterval time.Duration
+	stop                context.CancelFunc
+
+	mu              sync.Mutex
+	dirty           map[int64]struct{}
+	lastFullRefresh time.Time
+}
+
+func NewGraphRouter(
+	source graphSource,
+	maxRoutes int64,
+	refreshInterval time.Duration,
+	fullRefreshInterval time.Duration,
+) *graphRouter {
+	const (
+		maxHops     = 20
+		cltvRiskPpm = 10
+	)
+	ctx, stop := context.WithCancel(context.Background())
+	gr := &graphRouter{
+		graph:               newChannelGraph(),
+		source:              source,
+		maxRoutes:           maxRoutes,
+		maxHops:             maxHops,
+		cltvRiskPpm:         cltvRiskPpm,
+		fullRefreshInterval: fullRefreshInterval,
+		stop:                stop,
+		dirty:               map[int64]struct{}{},
+	}
+	go gr.refreshLoop(ctx, refreshInterval)
+	return gr
+}
+
+// Close stops the background refresh
+func (gr *graphRouter) Close() error {
+	gr.stop()
+	return nil
+}
+
+func (gr *graphRouter) FindRoutes(
+	ctx context.Context,
+	fromPubkeys []string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) ([]PaymentRoute, error) {
+	if gr.graph.isEmpty() {
+		return nil, stackerr.Wrap(fmt.Errorf("channel graph not loaded"))
+	}
+
+	sources := fromPubkeys
+	if len(sources) == 0 {
+		nodeId, err := gr.source.getNodeId(ctx)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		sources = []string{nodeId}
+	}
+
+	search := func(
+		ctx context.Context, fromPubkey string, excl RouteExclusions,
+	) (PaymentRoute, error) {
+		return gr.graph.findRoute(
+			fromPubkey, toPubkey, msat, excl, int64(gr.maxHops), limits,
+			gr.cltvRiskPpm,
+		)
+	}
+	routes, err := findAlternativeRoutes(
+		ctx, search, sources, msat, excl, limits, gr.maxRoutes,
+	)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return routes, nil
+}
+
+// invalidatePolicy drops the policy cached by the source, and fetches the
+// channel again on the next refresh
+func (gr *graphRouter) invalidatePolicy(scid int64) {
+	if pi, ok := gr.source.(policyInvalidator); ok {
+		pi.invalidatePolicy(scid)
+	}
+	gr.mu.Lock()
+	gr.dirty[scid] = struct{}{}
+	gr.mu.Unlock()
+}
+
+func (gr *graphRouter) inboundChannels(_ context.Context, nodeId string) ([]Hop, error) {
+	if gr.graph.isEmpty() {
+		return nil, stackerr.Wrap(fmt.Errorf("channel graph not loaded"))
+	}
+	return gr.graph.inboundHops(nodeId), nil
+}
+
+func (gr *graphRouter) nodeStats(_ context.Context) ([]nodeStats, error) {
+	if gr.graph.isEmpty() {
+		return nil, stackerr.Wrap(fmt.Errorf("channel graph not loaded"))
+	}
+	return gr.graph.nodeStats(), nil
+}
+
+func (gr *graphRouter) refreshLoop(ctx context.Context, interval time.Duration) {
+	for {
+		refreshCtx, cancel := context.WithTimeout(ctx, interval)
+		err := gr.refresh(refreshCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Println("error refreshing channel graph:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// refresh lists the whole graph when it is empty or its full refresh is
+// due, otherwise it only fetches the channels marked as changed
+func (gr *graphRouter) refresh(ctx context.Context) error {
+	gr.mu.Lock()
+	full := gr.graph.isEmpty() ||
+		time.Since(gr.lastFullRefresh) >= gr.fullRefreshInterval
+	gr.mu.Unlock()
+	if full {
+		return gr.fullRefresh(ctx)
+	}
+	return gr.refreshDirty(ctx)
+}
+
+func (gr *graphRouter) fullRefresh(ctx context.Context) error {
+	start := time.Now()
+	chans, err := gr.source.listChannels(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	nodes, err := gr.source.listNodes(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	nUpdated, nRemoved := gr.graph.applyChannels(chans)
+	gr.graph.applyNodes(nodes)
+	gr.mu.Lock()
+	gr.lastFullRefresh = start
+	// the full listing covers the channels changed meanwhile
+	gr.dirty = map[int64]struct{}{}
+	gr.mu.Unlock()
+	log.Printf(
+		"channel graph refreshed in %s: %d edges updated, %d removed\n",
+		time.Since(start), nUpdated, nRemoved,
+	)
+	return nil
+}
+
+// refreshDirty fetches again the channels marked as changed. Sources unable
+// to fetch a single channel wait for the next full refresh.
+func (gr *graphRouter) refreshDirty(ctx context.Context) error {
+	fetcher, ok := gr.source.(channelFetcher)
+	if !ok {
+		return nil
+	}
+	gr.mu.Lock()
+	dirty := gr.dirty
+	gr.dirty = map[int64]struct{}{}
+	gr.mu.Unlock()
+
+	for scid := range dirty {
+		chans, err := fetcher.listChannel(ctx, scid)
+		if err != nil {
+			gr.mu.Lock()
+			for scid := range dirty {
+				gr.dirty[scid] = struct{}{}
+			}
+			gr.mu.Unlock()
+			return stackerr.Wrap(err)
+		}
+		gr.graph.applyChannelUpdate(scid, chans)
+		delete(dirty, scid)
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// invoice is the routing relevant content of a BOLT11 invoice
+type invoice struct {
+	AmountMsat   int64
+	Payee        string
+	MinFinalCltv int64
+	// each route hint is a private path ending at the payee, its first hop
+	// node being reachable from the public graph
+	RouteHints []PaymentRoute
+}
+
+var errInvalidInvoice = errors.New("invalid invoice")
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// decodeInvoice decodes a BOLT11 invoice. The payee is recovered from the
+// signature when the invoice has no payee field.
+func decodeInvoice(s string) (invoice, error) {
+	const (
+		defaultMinFinalCltv = 18
+		timestampLen        = 7
+		signatureLen        = 104
+	)
+	var r invoice
+	hrp, data, err := bech32Decode(strings.ToLower(s))
+	if err != nil {
+		return r, stackerr.Wrap(err)
+	}
+	if len(data) < timestampLen+signatureLen {
+		return r, stackerr.Wrap(fmt.Errorf("invoice too short"))
+	}
+	r.AmountMsat, err = invoiceAmountMsat(hrp)
+	if err != nil {
+		return r, stackerr.Wrap(err)
+	}
+	r.MinFinalCltv = defaultMinFinalCltv
+
+	fields := data[timestampLen : len(data)-signatureLen]
+	for len(fields) >= 3 {
+		tag := fields[0]
+		l := int(fields[1])<<5 | int(fields[2])
+		if len(fields) < 3+l {
+			return r, stackerr.Wrap(fmt.Errorf("invoice field overflow"))
+		}
+		value := fields[3 : 3+l]
+		fields = fields[3+l:]
+
+		switch bech32Charset[tag] {
+		case 'n':
+			if l != 53 {
+				continue
+			}
+			r.Payee = hex.EncodeToString(regroupBits(value, 5, 8, false))
+		case 'c':
+			r.MinFinalCltv = 0
+			for _, v := range value {
+				r.MinFinalCltv = r.MinFinalCltv<<5 | int64(v)
+			}
+		case 'r':
+			hint, err := decodeRouteHint(regroupBits(value, 5, 8, false))
+			if err != nil {
+				return r, stackerr.Wrap(err)
+			}
+			r.RouteHints = append(r.RouteHints, hint)
+		}
+	}
+
+	if r.Payee == "" {
+		sig := regroupBits(data[len(data)-signatureLen:], 5, 8, false)
+		// the signed data is padded to a byte boundary
+		msg := append([]byte(hrp), regroupBits(data[:len(data)-signatureLen], 5, 8, true)...)
+		hash := sha256.Sum256(msg)
+		pubkey, err := secpRecoverPubkey(hash[:], sig[:64], sig[64])
+		if err != nil {
+			return r, stackerr.Wrap(err)
+		}
+		r.Payee = hex.EncodeToString(pubkey)
+	}
+	return r, nil
+}
+
+// decodeRouteHint decodes the hops of an r field, each made of the node
+// pubkey, short channel id, fee base, fee rate and cltv delta
+func decodeRouteHint(b []byte) (PaymentRoute, error) {
+	const hopLen = 33 + 8 + 4 + 4 + 2
+	if len(b) == 0 || len(b)%hopLen != 0 {
+		return nil, fmt.Errorf("invalid route hint length %d", len(b))
+	}
+	var r PaymentRoute
+	for ; len(b) > 0; b = b[hopLen:] {
+		r = append(r, Hop{
+			NodeId:                    hex.EncodeToString(b[:33]),
+			ShortChannelId:            int64(binary.BigEndian.Uint64(b[33:41])),
+			FeeBaseMsat:               int32(binary.BigEndian.Uint32(b[41:45])),
+			FeeProportionalMillionths: int32(binary.BigEndian.Uint32(b[45:49])),
+			CltvExpiryDelta:           int16(binary.BigEndian.Uint16(b[49:51])),
+		})
+	}
+	return r, nil
+}
+
+// invoiceAmountMsat parses the amount in the invoice human readable part, 0
+// when the invoice has no amount
+func invoiceAmountMsat(hrp string) (int64, error) {
+	if !strings.HasPrefix(hrp, "ln") {
+		return 0, fmt.Errorf("invalid invoice prefix: %s", hrp)
+	}
+	i := strings.IndexAny(hrp, "0123456789")
+	if i < 0 {
+		return 0, nil
+	}
+	amount, unit := hrp[i:], hrp[len(hrp)-1]
+	if unit > '9' {
+		amount = amount[:len(amount)-1]
+	}
+	n, err := strconv.ParseUint(amount, 10, 63)
+	if err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+	// 1 btc is 10^11 msat
+	var multiplier uint64
+	switch unit {
+	case 'm':
+		multiplier = 100_000_000
+	case 'u':
+		multiplier = 100_000
+	case 'n':
+		multiplier = 100
+	case 'p':
+		if n%10 != 0 {
+			return 0, fmt.Errorf("invalid sub-msat amount: %s", hrp[i:])
+		}
+		return int64(n / 10), nil
+	default:
+		if unit > '9' {
+			return 0, fmt.Errorf("invalid amount multiplier: %c", unit)
+		}
+		multiplier = 100_000_000_000
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("amount overflow: %s", hrp[i:])
+	}
+	return int64(n * multiplier), nil
+}
+
+// bech32Decode splits a bech32 string in its human readable part and its 5
+// bit groups, checksum excluded. Invoices exceed the 90 characters limit of
+// addresses, so no length limit is applied.
+func bech32Decode(s string) (string, []byte, error) {
+	const checksumLen = 6
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+checksumLen+1 > len(s) {
+		return "", nil, fmt.Errorf("invalid bech32 separator position")
+	}
+	hrp := s[:sep]
+	data := make([]byte, 0, len(s)-sep-1)
+	for _, c := range s[sep+1:] {
+		v := strings.IndexRune(bech32Charset, c)
+		if v < 0 {
+			return "", nil, fmt.Errorf("invalid bech32 character %q", c)
+		}
+		data = append(data, byte(v))
+	}
+
+	values := make([]byte, 0, 2*len(hrp)+1+len(data))
+	for _, c := range []byte(hrp) {
+		values = append(values, c>>5)
+	}
+	values = append(values, 0)
+	for _, c := range []byte(hrp) {
+		values = append(values, c&31)
+	}
+	values = append(values, data...)
+	if bech32Polymod(values) != 1 {
+		return "", nil, fmt.Errorf("invalid bech32 checksum")
+	}
+	return hrp, data[:len(data)-checksumLen], nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range 5 {
+			if (b>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// regroupBits converts groups of fromBits bits to groups of toBits bits. The
+// incomplete last group is padded with zeros when pad is set, dropped
+// otherwise.
+func regroupBits(data []byte, fromBits, toBits uint, pad bool) []byte {
+	var (
+		acc  uint32
+		bits uint
+		r    = make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+	)
+	for _, v := range data {
+		acc = acc<<fromBits | uint32(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			r = append(r, byte(acc>>bits&(1<<toBits-1)))
+		}
+	}
+	if bits > 0 && pad {
+		r = append(r, byte(acc<<(toBits-bits)&(1<<toBits-1)))
+	}
+	return r
+}
+
+// findInvoiceRoutes finds routes to the invoice payee. With route hints, the
+// public part of the routes ends at the hint entry node and the hinted
+// private hops are appended. A source being the payee or a hint entry node
+// needs no search: the route from it is empty or the hint alone.
+func findInvoiceRoutes(
+	ctx context.Context,
+	rf RouteFinder,
+	fromPubkeys []string,
+	inv invoice,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+	maxRoutes int64,
+) ([]PaymentRoute, error) {
+	isSource := func(nodeId string) bool {
+		return slices.ContainsFunc(fromPubkeys, func(v string) bool {
+			return strings.EqualFold(v, nodeId)
+		})
+	}
+	if isSource(inv.Payee) {
+		return []PaymentRoute{{}}, nil
+	}
+	if len(inv.RouteHints) == 0 {
+		limits.MaxCltv = remainingLimit(limits.MaxCltv, inv.MinFinalCltv)
+		if limits.MaxCltv < 0 {
+			return nil, stackerr.Wrap(errNoRouteWithinBudget)
+		}
+		routes, err := rf.FindRoutes(ctx, fromPubkeys, inv.Payee, msat, excl, limits)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		return routes, nil
+	}
+
+	var (
+		routes  []PaymentRoute
+		lastErr error
+	)
+	for _, hint := range inv.RouteHints {
+		// the public part carries the amount plus the hint fees, within
+		// what is left of the limits
+		hintFee := routeFeeMsat(hint, msat)
+		legLimits := RouteLimits{
+			MaxFeeMsat: remainingLimit(limits.maxFeeMsat(msat), hintFee),
+			MaxCltv:    remainingLimit(limits.MaxCltv, routeCltv(hint)+inv.MinFinalCltv),
+			MaxHops:    remainingLimit(limits.MaxHops, int64(len(hint))),
+		}
+		if legLimits.MaxFeeMsat < 0 || legLimits.MaxCltv < 0 || legLimits.MaxHops < 0 {
+			lastErr = errNoRouteWithinBudget
+			continue
+		}
+		if isSource(hint[0].NodeId) {
+			routes = append(routes, slices.Clone(hint))
+			continue
+		}
+
+		legs, err := rf.FindRoutes(
+			ctx, fromPubkeys, hint[0].NodeId, msat+hintFee, excl, legLimits,
+		)
+		if err != nil {
+			log.Printf("no route to hint entry %s: %s\n", hint[0].NodeId, err)
+			lastErr = err
+			continue
+		}
+		for _, leg := range legs {
+			route := make(PaymentRoute, 0, len(leg)+len(hint))
+			routes = append(routes, append(append(route, leg...), hint...))
+		}
+	}
+	if len(routes) == 0 && lastErr != nil {
+		return nil, stackerr.Wrap(lastErr)
+	}
+	sortRoutes(routes, msat)
+	if int64(len(routes)) > maxRoutes {
+		routes = routes[:maxRoutes]
+	}
+	return routes, nil
+}
+
+// remainingLimit is what is left of the limit once used is spent. Unlimited
+// stays unlimited, and a negative value is returned when nothing is left.
+func remainingLimit(limit, used int64) int64 {
+	if limit == 0 {
+		return 0
+	}
+	if limit <= used {
+		return -1
+	}
+	return limit - used
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_decodeInvoice(t *testing.T) {
+	const payee = "03e7156ae33b0a208d0744199163177e909e80176e55d97a2f221ede0f934dd9ad"
+
+	// bolt11 test vector, no amount and no payee field
+	inv, err := decodeInvoice("lnbc1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq9qrsgq357wnc5r2ueh7ck6q93dj32dlqnls087fxdwk8qakdyafkq3yap9us6v52vjjsrvywa6rt52cm9r9zqt8r2t7mlcwspyetp5h2tztugp9lfyql")
+	tu.Must(t, err)
+
+	expected := invoice{Payee: payee, MinFinalCltv: 18}
+	if !reflect.DeepEqual(expected, inv) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, inv)
+	}
+
+	// bolt11 test vector with route hints
+	inv, err = decodeInvoice("lnbc20m1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqhp58yjmdan79s6qqdhdzgynm4zwqd5d7xmw5fk98klysy043l2ahrqsfpp3qjmp7lwpagxun9pygexvgpjdc4jdj85fr9yq20q82gphp2nflc7jtzrcazrra7wwgzxqc8u7754cdlpfrmccae92qgzqvzq2ps8pqqqqqqpqqqqq9qqqvpeuqafqxu92d8lr6fvg0r5gv0heeeqgcrqlnm6jhphu9y00rrhy4grqszsvpcgpy9qqqqqqgqqqqq7qqzq9qrsgqdfjcdk6w3ak5pca9hwfwfh63zrrz06wwfya0ydlzpgzxkn5xagsqz7x9j4jwe7yj7vaf2k9lqsdk45kts2fd0fkr28am0u4w95tt2nsq76cqw0")
+	tu.Must(t, err)
+
+	expected = invoice{
+		AmountMsat:   2_000_000_000,
+		Payee:        payee,
+		MinFinalCltv: 18,
+		RouteHints: []PaymentRoute{{
+			{
+				NodeId:                    "029e03a901b85534ff1e92c43c74431f7ce72046060fcf7a95c37e148f78c77255",
+				ShortChannelId:            0x0102030405060708,
+				FeeBaseMsat:               1,
+				FeeProportionalMillionths: 20,
+				CltvExpiryDelta:           3,
+			},
+			{
+				NodeId:                    "039e03a901b85534ff1e92c43c74431f7ce72046060fcf7a95c37e148f78c77255",
+				ShortChannelId:            0x030405060708090a,
+				FeeBaseMsat:               2,
+				FeeProportionalMillionths: 30,
+				CltvExpiryDelta:           4,
+			},
+		}},
+	}
+	if !reflect.DeepEqual(expected, inv) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, inv)
+	}
+}
+
+type fakeRouteFinder struct {
+	routes map[string]PaymentRoute
+	msat   map[string]int64
+}
+
+func (f *fakeRouteFinder) FindRoutes(
+	_ context.Context,
+	_ []string,
+	toPubkey string,
+	msat int64,
+	_ RouteExclusions,
+	limits RouteLimits,
+) ([]PaymentRoute, error) {
+	f.msat[toPubkey] = msat
+	route := f.routes[toPubkey]
+	if err := limits.check(route, msat); err != nil {
+		return nil, errNoRouteWithinBudget
+	}
+	return []PaymentRoute{route}, nil
+}
+
+func Test_findInvoiceRoutes(t *testing.T) {
+	rf := &fakeRouteFinder{
+		routes: map[string]PaymentRoute{
+			"b": {{NodeId: "a", ShortChannelId: 1, FeeBaseMsat: 1000}},
+		},
+		msat: map[string]int64{},
+	}
+	hint := PaymentRoute{
+		{NodeId: "b", ShortChannelId: 2, FeeProportionalMillionths: 1000, CltvExpiryDelta: 40},
+	}
+	inv := invoice{Payee: "c", MinFinalCltv: 18, RouteHints: []PaymentRoute{hint}}
+
+	ctx := context.Background()
+	r, err := findInvoiceRoutes(
+		ctx, rf, nil, inv, 1_000_000, RouteExclusions{}, RouteLimits{}, 3,
+	)
+	tu.Must(t, err)
+
+	expected := []PaymentRoute{append(rf.routes["b"], hint...)}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+	// the route to the hint entry carries the hint fee
+	if v := rf.msat["b"]; v != 1_001_000 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 1_001_000, v)
+	}
+
+	// the hint fee alone exhausts the budget
+	_, err = findInvoiceRoutes(
+		ctx, rf, nil, inv, 1_000_000, RouteExclusions{}, RouteLimits{MaxFeeMsat: 1000}, 3,
+	)
+	if !errors.Is(err, errNoRouteWithinBudget) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", errNoRouteWithinBudget, err)
+	}
+
+	// the routes through each hint are capped to the cheapest maxRoutes
+	rf.routes["d"] = PaymentRoute{{NodeId: "a", ShortChannelId: 3, FeeBaseMsat: 5000}}
+	inv.RouteHints = append(inv.RouteHints, PaymentRoute{
+		{NodeId: "d", ShortChannelId: 4, CltvExpiryDelta: 40},
+	})
+	r, err = findInvoiceRoutes(
+		ctx, rf, nil, inv, 1_000_000, RouteExclusions{}, RouteLimits{}, 1,
+	)
+	tu.Must(t, err)
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	// a source being the hint entry or the payee is not searched from
+	rf.msat = map[string]int64{}
+	r, err = findInvoiceRoutes(
+		ctx, rf, []string{"a", "B"}, inv, 1_000_000, RouteExclusions{}, RouteLimits{}, 1,
+	)
+	tu.Must(t, err)
+	expected = []PaymentRoute{hint}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+	if _, ok := rf.msat["b"]; ok {
+		t.Fatal("unexpected search to the hint entry")
+	}
+	rf.msat = map[string]int64{}
+	r, err = findInvoiceRoutes(
+		ctx, rf, []string{"c"}, inv, 1_000_000, RouteExclusions{}, RouteLimits{}, 3,
+	)
+	tu.Must(t, err)
+	expected = []PaymentRoute{{}}
+	if !reflect.DeepEqual(expected, r) || len(rf.msat) != 0 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+}
+
+func Test_invoiceAmountMsat(t *testing.T) {
+	payload := map[string]int64{
+		"lnbc":         0,
+		"lnbc2500u":    250_000_000,
+		"lnbc25m":      2_500_000_000,
+		"lnbc10n":      1_000,
+		"lnbc2500000p": 250_000,
+		"lntb20":       2_000_000_000_000,
+	}
+	for hrp, expected := range payload {
+		r, err := invoiceAmountMsat(hrp)
+		tu.Must(t, err)
+		if r != expected {
+			t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+		}
+	}
+
+	for _, hrp := range []string{
+		"lnbc25x", "lnbc25p", "lnbc92233720368547758m", "lnbc99999999999999999",
+	} {
+		if _, err := invoiceAmountMsat(hrp); err == nil {
+			t.Fatal("expecting an error for", hrp)
+		}
+	}
+}
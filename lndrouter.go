@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// lndRouter finds routes through the REST API of a LND node
+type lndRouter struct {
+	c         *http.Client
+	url       string
+	macaroon  string
+	maxRoutes int64
+}
+
+func NewLndRouter(
+	url, macaroonPath, tlsCertPath string, maxRoutes int64,
+) *lndRouter {
+	macaroon, err := os.ReadFile(macaroonPath)
+	if err != nil {
+		panic(stackerr.Wrap(err))
+	}
+	tlsCert, err := os.ReadFile(tlsCertPath)
+	if err != nil {
+		panic(stackerr.Wrap(err))
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(tlsCert) {
+		panic(stackerr.Wrap(fmt.Errorf("invalid lnd tls cert: %s", tlsCertPath)))
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: certPool}
+
+	return &lndRouter{
+		c: &http.Client{
+			Timeout:   time.Second * 60,
+			Transport: transport,
+		},
+		url:       strings.TrimSuffix(url, "/"),
+		macaroon:  hex.EncodeToString(macaroon),
+		maxRoutes: maxRoutes,
+	}
+}
+
+func (lr *lndRouter) FindRoutes(
+	ctx context.Context,
+	fromPubkeys []string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) ([]PaymentRoute, error) {
+	sources := fromPubkeys
+	if len(sources) == 0 {
+		nodeId, err := lr.getNodeId(ctx)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		sources = []string{nodeId}
+	}
+
+	search := func(
+		ctx context.Context, fromPubkey string, excl RouteExclusions,
+	) (PaymentRoute, error) {
+		return lr.findRoute(ctx, fromPubkey, toPubkey, msat, excl, limits)
+	}
+	routes, err := findAlternativeRoutes(
+		ctx, search, sources, msat, excl, limits, lr.maxRoutes,
+	)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return routes, nil
+}
+
+func (lr *lndRouter) findRoute(
+	ctx context.Context,
+	fromPubkey, toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) (PaymentRoute, error) {
+	route, err := lr.queryRoute(ctx, fromPubkey, toPubkey, msat, excl, limits)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	edges := make(map[int64]lndEdge, len(route.Hops))
+	for _, v := range route.Hops {
+		edge, err := lr.getEdge(ctx, v.ChanId)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		edges[v.ChanId] = edge
+	}
+
+	return lndDataToPaymentRoute(fromPubkey, route, edges), nil
+}
+
+func (lr *lndRouter) getNodeId(ctx context.Context) (string, error) {
+	var r struct {
+		IdentityPubkey string `json:"identity_pubkey"`
+	}
+	err := lr.call(ctx, "GET", "/v1/getinfo", nil, &r)
+	if err != nil {
+		return "", stackerr.Wrap(err)
+	}
+	return r.IdentityPubkey, nil
+}
+
+func (lr *lndRouter) queryRoute(
+	ctx context.Context,
+	fromPubkey, toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) (lndRoute, error) {
+	type edgeLocator struct {
+		ChannelId        int64 `json:"channel_id,string"`
+		DirectionReverse bool  `json:"direction_reverse"`
+	}
+	type feeLimit struct {
+		FixedMsat int64 `json:"fixed_msat,string"`
+	}
+	var r struct {
+		Routes []lndRoute `json:"routes"`
+	}
+	params := struct {
+		PubKey            string        `json:"pub_key"`
+		AmtMsat           int64         `json:"amt_msat,string"`
+		SourcePubKey      string        `json:"source_pub_key"`
+		IgnoredNodes      [][]byte      `json:"ignored_nodes,omitempty"`
+		IgnoredEdges      []edgeLocator `json:"ignored_edges,omitempty"`
+		UseMissionControl bool          `json:"use_mission_control"`
+		FeeLimit          *feeLimit     `json:"fee_limit,omitempty"`
+		CltvLimit         int64         `json:"cltv_limit,omitempty"`
+	}{
+		PubKey:       strings.ToLower(toPubkey),
+		AmtMsat:      msat,
+		SourcePubKey: strings.ToLower(fromPubkey),
+		CltvLimit:    limits.MaxCltv,
+	}
+	if maxFeeMsat := limits.maxFeeMsat(msat); maxFeeMsat > 0 {
+		params.FeeLimit = &feeLimit{maxFeeMsat}
+	}
+	for _, v := range excl.Nodes {
+		nodeId, err := hex.DecodeString(v)
+		if err != nil {
+			return lndRoute{}, stackerr.Wrap(err)
+		}
+		params.IgnoredNodes = append(params.IgnoredNodes, nodeId)
+	}
+	// channels are ignored in both directions
+	for _, v := range excl.Chans {
+		params.IgnoredEdges = append(params.IgnoredEdges,
+			edgeLocator{v, false}, edgeLocator{v, true},
+		)
+	}
+
+	err := lr.call(ctx, "POST", "/v1/graph/routes", params, &r)
+	if err != nil {
+		return lndRoute{}, stackerr.Wrap(err)
+	}
+	if len(r.Routes) == 0 {
+		return lndRoute{}, stackerr.Wrap(fmt.Errorf("lnd returned no routes"))
+	}
+	return r.Routes[0], nil
+}
+
+func (lr *lndRouter) getEdge(
+	ctx context.Context, chanId int64,
+) (lndEdge, error) {
+	var r lndEdge
+	path := "/v1/graph/edge/" + strconv.FormatInt(chanId, 10)
+	err := lr.call(ctx, "GET", path, nil, &r)
+	if err != nil {
+		return r, stackerr.Wrap(err)
+	}
+	return r, nil
+}
+
+func (lr *lndRouter) call(
+	ctx context.Context, method, path string, params, result interface{},
+) error {
+	var body io.Reader
+	if params != nil {
+		buf := &bytes.Buffer{}
+		err := json.NewEncoder(buf).Encode(params)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		body = buf
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, lr.url+path, body)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	req.Header.Set("Grpc-Metadata-macaroon", lr.macaroon)
+
+	res, err := lr.c.Do(req)
+	if err != nil {
+		return stackerr.Wrap(fmt.Errorf("%w: %w", errLnUnavailable, err))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		var lndErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(res.Body).Decode(&lndErr)
+		return stackerr.Wrap(fmt.Errorf(
+			"invalid status calling lnd %s: %d: %s",
+			path, res.StatusCode, lndErr.Message,
+		))
+	}
+	err = json.NewDecoder(res.Body).Decode(result)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// lndDataToPaymentRoute builds the payment route starting at fromPubkey, the
+// node that forwards through the first channel of the route
+func lndDataToPaymentRoute(
+	fromPubkey string, route lndRoute, edges map[int64]lndEdge,
+) PaymentRoute {
+
+	hops := []Hop{}
+	for i, lndHop := range route.Hops {
+		var hop Hop
+
+		if i == 0 {
+			hop.NodeId = strings.ToLower(fromPubkey)
+		} else {
+			hop.NodeId = route.Hops[i-1].PubKey
+		}
+
+		hop.ShortChannelId = lndHop.ChanId
+
+		edge := edges[lndHop.ChanId]
+		sourcePolicy := edge.Node2Policy
+		if edge.Node1Pub == hop.NodeId {
+			sourcePolicy = edge.Node1Policy
+		}
+
+		hop.CltvExpiryDelta = int16(sourcePolicy.TimeLockDelta)
+		hop.HtlcMinimumMsat = sourcePolicy.MinHtlc
+		hop.FeeBaseMsat = int32(sourcePolicy.FeeBaseMsat)
+		hop.FeeProportionalMillionths = int32(sourcePolicy.FeeRateMilliMsat)
+		hop.HtlcMaximumMsat = int64(sourcePolicy.MaxHtlcMsat)
+		hop.Disabled = sourcePolicy.Disabled
+
+		hops = append(hops, hop)
+	}
+
+	return hops
+}
+
+type lndRoute struct {
+	TotalTimeLock int64    `json:"total_time_lock"`
+	Hops          []lndHop `json:"hops"`
+}
+
+type lndHop struct {
+	ChanId           int64  `json:"chan_id,string"`
+	PubKey           string `json:"pub_key"`
+	Expiry           int64  `json:"expiry"`
+	AmtToForwardMsat int64  `json:"amt_to_forward_msat,string"`
+	FeeMsat          int64  `json:"fee_msat,string"`
+}
+
+type lndEdge struct {
+	ChannelId   int64            `json:"channel_id,string"`
+	Node1Pub    string           `json:"node1_pub"`
+	Node2Pub    string           `json:"node2_pub"`
+	Capacity    int64            `json:"capacity,string"`
+	Node1Policy lndRoutingPolicy `json:"node1_policy"`
+	Node2Policy lndRoutingPolicy `json:"node2_policy"`
+}
+
+type lndRoutingPolicy struct {
+	TimeLockDelta    int32  `json:"time_lock_delta"`
+	MinHtlc          int64  `json:"min_htlc,string"`
+	FeeBaseMsat      int64  `json:"fee_base_msat,string"`
+	FeeRateMilliMsat int64  `json:"fee_rate_milli_msat,string"`
+	Disabled         bool   `json:"disabled"`
+	MaxHtlcMsat      uint64 `json:"max_htlc_msat,string"`
+	LastUpdate       int64  `json:"last_update"`
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_lndDataToPaymentRoute(t *testing.T) {
+	routePayload := `{
+		"total_time_lock": 877500,
+		"hops": [
+			{
+				"chan_id": "964531182376583168",
+				"pub_key": "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+				"expiry": 877480,
+				"amt_to_forward_msat": "1003000",
+				"fee_msat": "451"
+			},
+			{
+				"chan_id": "964531182376648704",
+				"pub_key": "03dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd",
+				"expiry": 877270,
+				"amt_to_forward_msat": "1000000",
+				"fee_msat": "3000"
+			}
+		]
+	}`
+	edgesPayload := []string{
+		`{
+			"channel_id": "964531182376583168",
+			"node1_pub": "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			"node2_pub": "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+			"capacity": "7000000",
+			"node1_policy": {
+				"time_lock_delta": 34,
+				"min_htlc": "1",
+				"fee_base_msat": "0",
+				"fee_rate_milli_msat": "450",
+				"disabled": false,
+				"max_htlc_msat": "6930000000",
+				"last_update": 1700000000
+			},
+			"node2_policy": {
+				"time_lock_delta": 210,
+				"min_htlc": "1000",
+				"fee_base_msat": "0",
+				"fee_rate_milli_msat": "3000",
+				"disabled": false,
+				"max_htlc_msat": "21049000",
+				"last_update": 1700000000
+			}
+		}`,
+		`{
+			"channel_id": "964531182376648704",
+			"node1_pub": "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+			"node2_pub": "03dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd",
+			"capacity": "10000000",
+			"node1_policy": {
+				"time_lock_delta": 210,
+				"min_htlc": "1000",
+				"fee_base_msat": "0",
+				"fee_rate_milli_msat": "3000",
+				"disabled": false,
+				"max_htlc_msat": "8117000",
+				"last_update": 1700000000
+			},
+			"node2_policy": {
+				"time_lock_delta": 80,
+				"min_htlc": "1000",
+				"fee_base_msat": "1000",
+				"fee_rate_milli_msat": "1",
+				"disabled": false,
+				"max_htlc_msat": "9900000000",
+				"last_update": 1700000000
+			}
+		}`,
+	}
+
+	var route lndRoute
+	tu.Must(t, json.Unmarshal([]byte(routePayload), &route))
+	edges := map[int64]lndEdge{}
+	for i, v := range edgesPayload {
+		var edge lndEdge
+		tu.MustIdx(t, i, json.Unmarshal([]byte(v), &edge))
+		edges[edge.ChannelId] = edge
+	}
+
+	expected := PaymentRoute{
+		{
+			NodeId:                    "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			ShortChannelId:            964531182376583168,
+			CltvExpiryDelta:           34,
+			HtlcMinimumMsat:           1,
+			FeeBaseMsat:               0,
+			FeeProportionalMillionths: 450,
+			HtlcMaximumMsat:           6930000000,
+		},
+		{
+			NodeId:                    "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+			ShortChannelId:            964531182376648704,
+			CltvExpiryDelta:           210,
+			HtlcMinimumMsat:           1000,
+			FeeBaseMsat:               0,
+			FeeProportionalMillionths: 3000,
+			HtlcMaximumMsat:           8117000,
+		},
+	}
+
+	r := lndDataToPaymentRoute(
+		"02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		route,
+		edges,
+	)
+
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+}
+
+func Test_lndRouterQueryRoute(t *testing.T) {
+	const (
+		a = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		b = "03bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+		c = "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+	)
+	var body map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/graph/routes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Grpc-Metadata-macaroon") != "abcd" {
+			t.Error("missing macaroon")
+		}
+		tu.Must(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Write([]byte(`{"routes":[{"total_time_lock":877500,"hops":[]}]}`))
+	})
+	// excluded channels are not looked up, closed ones being unknown to lnd
+	mux.HandleFunc("GET /v1/graph/edge/{id}", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected edge lookup:", r.PathValue("id"))
+		w.WriteHeader(http.StatusNotFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	lr := &lndRouter{c: srv.Client(), url: srv.URL, macaroon: "abcd", maxRoutes: 1}
+
+	excl := RouteExclusions{Nodes: []string{c}, Chans: []int64{964531182376583168}}
+	limits := RouteLimits{MaxFeeMsat: 5000, MaxCltv: 500}
+	_, err := lr.queryRoute(context.Background(), a, b, 1_000_000, excl, limits)
+	tu.Must(t, err)
+
+	// bytes are base64 encoded
+	const cBase64 = "A8zMzMzMzMzMzMzMzMzMzMzMzMzMzMzMzMzMzMzMzMzM"
+	expected := map[string]interface{}{
+		"pub_key":             b,
+		"amt_msat":            "1000000",
+		"source_pub_key":      a,
+		"ignored_nodes":       []interface{}{cBase64},
+		"use_mission_control": false,
+		"ignored_edges": []interface{}{
+			map[string]interface{}{"channel_id": "964531182376583168", "direction_reverse": false},
+			map[string]interface{}{"channel_id": "964531182376583168", "direction_reverse": true},
+		},
+		"fee_limit":  map[string]interface{}{"fixed_msat": "5000"},
+		"cltv_limit": float64(500),
+	}
+	if !reflect.DeepEqual(expected, body) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, body)
+	}
+}
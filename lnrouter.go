@@ -1,76 +1,299 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"log"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"master.private/bstd.git/jsonrpc"
 	"master.private/bstd.git/stackerr"
 )
 
 type lnRouter struct {
-	client *jsonrpc.Client
+	client *clnPool
+	// probeClient is the connection of the probes, which wait for their
+	// failure without holding a pool connection
+	probeClient *clnConn
+	policies    *policyCache
+	maxRoutes   int64
+	stopPoll    context.CancelFunc
+
+	// the whole graph, listed on the node stats requests only
+	statsMu       sync.Mutex
+	statsGraph    *channelGraph
+	statsListedAt time.Time
+	statsListing  bool
 }
 
-func NewLnRouter(network, address string) *lnRouter {
-	conn, err := net.Dial(network, address)
-	if err != nil {
-		panic(stackerr.Wrap(err))
+// NewLnRouter doesn't connect to CLN, the connections are established on
+// their first call. Every policyPollInterval, the channels are listed again
+// to drop the cached ones with a newer channel update, 0 disabling the poll.
+func NewLnRouter(
+	network, address string,
+	poolSize, maxRoutes int64,
+	policyCacheTtl time.Duration,
+	policyPollInterval time.Duration,
+) *lnRouter {
+	ctx, stopPoll := context.WithCancel(context.Background())
+	lr := &lnRouter{
+		client:      newClnPool(network, address, poolSize),
+		probeClient: newClnConn(network, address),
+		policies:    newPolicyCache(policyCacheTtl),
+		maxRoutes:   maxRoutes,
+		stopPoll:    stopPoll,
+		statsGraph:  newChannelGraph(),
 	}
-	return &lnRouter{
-		client: jsonrpc.NewClient(conn),
+	if policyPollInterval > 0 {
+		go lr.pollLoop(ctx, policyPollInterval)
 	}
+	return lr
 }
 
 func (lr *lnRouter) FindRoutes(
-	fromPubkeys []string, toPubkey string, msat int64,
+	ctx context.Context,
+	fromPubkeys []string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
 ) ([]PaymentRoute, error) {
+	sources := fromPubkeys
+	if len(sources) == 0 {
+		nodeId, err := lr.getNodeId(ctx)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		sources = []string{nodeId}
+	}
 
-	clnRoute, err := lr.getRoute(toPubkey, msat)
+	search := func(
+		ctx context.Context, fromPubkey string, excl RouteExclusions,
+	) (PaymentRoute, error) {
+		return lr.findRoute(ctx, fromPubkey, toPubkey, msat, excl, limits)
+	}
+	routes, err := findAlternativeRoutes(
+		ctx, search, sources, msat, excl, limits, lr.maxRoutes,
+	)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return routes, nil
+}
+
+func (lr *lnRouter) findRoute(
+	ctx context.Context,
+	fromPubkey, toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) (PaymentRoute, error) {
+	clnRoute, err := lr.getRoute(ctx, fromPubkey, toPubkey, msat, excl, limits)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	// the channels are looked up concurrently, each on its own connection
+	var (
+		wg          sync.WaitGroup
+		channels    = make([][]clnChan, len(clnRoute.Hops))
+		channelErrs = make([]error, len(clnRoute.Hops))
+	)
+	for i, v := range clnRoute.Hops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			channels[i], channelErrs[i] = lr.getChan(ctx, v.ShortChannelId)
+		}()
+	}
+	wg.Wait()
+	err = errors.Join(channelErrs...)
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
 
 	channelsData := make(map[int64][]clnChan, len(clnRoute.Hops))
-	for _, v := range clnRoute.Hops {
-		cd, err := lr.getChan(v.ShortChannelId)
-		if err != nil {
+	for _, cd := range channels {
+		channelsData[mustShortChannelIdToInt(cd[0].ShortChannelId)] = cd
+	}
+
+	return clnDataToPaymentRoute(fromPubkey, clnRoute, channelsData), nil
+}
+
+func (lr *lnRouter) Stats() map[string]int64 {
+	return lr.policies.stats()
+}
+
+func (lr *lnRouter) invalidatePolicy(scid int64) {
+	lr.policies.invalidate(scid)
+}
+
+// nodeStats computes the node stats from the whole graph, listed again at
+// most every nodeStatsRefresh. The graph is kept between listings, for the
+// disable toggles to be counted. A single request lists the graph, without
+// holding statsMu, the others using the previous listing meanwhile.
+func (lr *lnRouter) nodeStats(ctx context.Context) ([]nodeStats, error) {
+	const nodeStatsRefresh = 10 * time.Minute
+	lr.statsMu.Lock()
+	listed := !lr.statsListedAt.IsZero()
+	list := !lr.statsListing && time.Since(lr.statsListedAt) > nodeStatsRefresh
+	if list {
+		lr.statsListing = true
+	}
+	lr.statsMu.Unlock()
+
+	if list {
+		err := lr.listStatsGraph(ctx)
+		lr.statsMu.Lock()
+		lr.statsListing = false
+		if err == nil {
+			lr.statsListedAt = time.Now()
+			listed = true
+		}
+		lr.statsMu.Unlock()
+		if err != nil && !listed {
 			return nil, stackerr.Wrap(err)
 		}
-		channelsData[mustShortChannelIdToInt(cd[0].ShortChannelId)] = cd
+		if err != nil {
+			log.Println("error listing the graph of the node stats:", err)
+		}
 	}
+	if !listed {
+		return nil, stackerr.Wrap(fmt.Errorf("graph of the node stats being listed"))
+	}
+	return lr.statsGraph.nodeStats(), nil
+}
 
-	paymentRoute := clnDataToPaymentRoute(clnRoute, channelsData)
+func (lr *lnRouter) listStatsGraph(ctx context.Context) error {
+	chans, err := lr.listChannels(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	nodes, err := lr.listNodes(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	lr.statsGraph.applyChannels(chans)
+	lr.statsGraph.applyNodes(nodes)
+	return nil
+}
 
-	return []PaymentRoute{paymentRoute}, nil
+func (lr *lnRouter) pollLoop(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		pollCtx, cancel := context.WithTimeout(ctx, interval)
+		err := lr.pollPolicies(pollCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Println("error polling channel policies:", err)
+		}
+	}
+}
+
+// pollPolicies lists the channels once, dropping the cached ones updated
+// since they were cached. Nothing is listed while the cache is empty.
+func (lr *lnRouter) pollPolicies(ctx context.Context) error {
+	if len(lr.policies.scids()) == 0 {
+		return nil
+	}
+	// listChannels observes the updates of the listed channels
+	_, err := lr.listChannels(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
 }
 
 func (lr *lnRouter) Close() error {
-	err := lr.client.Close()
+	lr.stopPoll()
+	err := errors.Join(lr.client.Close(), lr.probeClient.Close())
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
 	return nil
 }
 
-func (lr *lnRouter) getRoute(toPubkey string, msat int64) (clnRoute, error) {
+// getNodeId returns the id of the lightning node, to be used as route source
+// when the wallet doesn't inform its peers
+func (lr *lnRouter) getNodeId(ctx context.Context) (string, error) {
+	info, err := lr.client.nodeInfo(ctx)
+	if err != nil {
+		return "", stackerr.Wrap(err)
+	}
+	return info.Id, nil
+}
+
+// getRoute asks CLN for a route using the routing api of the connected
+// version
+func (lr *lnRouter) getRoute(
+	ctx context.Context,
+	fromPubkey, toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) (clnRoute, error) {
 	const (
-		riskFactor = 0
-		maxHops    = 5
+		riskFactor     = 0
+		defaultMaxHops = 5
 	)
-	var r clnRoute
-	params := struct {
-		ToPubkey   string `json:"id"`
-		AmountMsat int64  `json:"msatoshi"`
-		RiskFactor int64  `json:"riskfactor"`
-		MaxHops    int64  `json:"maxhops"`
-	}{
-		toPubkey, msat, riskFactor, maxHops,
+	var (
+		r       clnRoute
+		err     error
+		params  interface{}
+		maxHops int64 = defaultMaxHops
+	)
+	if limits.MaxHops > 0 {
+		maxHops = limits.MaxHops
+	}
+	info, err := lr.client.nodeInfo(ctx)
+	if err != nil {
+		return r, stackerr.Wrap(err)
+	}
+
+	switch clnSchemaFromVersion(info.Version) {
+	case clnSchemaAskrene:
+		r, err = lr.getRouteAskrene(ctx, fromPubkey, toPubkey, msat, excl, limits)
+		if err != nil {
+			return r, stackerr.Wrap(err)
+		}
+		return r, nil
+	case clnSchemaLegacy:
+		params = struct {
+			ToPubkey   string   `json:"id"`
+			AmountMsat int64    `json:"msatoshi"`
+			RiskFactor int64    `json:"riskfactor"`
+			FromPubkey string   `json:"fromid"`
+			MaxHops    int64    `json:"maxhops"`
+			Exclude    []string `json:"exclude,omitempty"`
+		}{
+			toPubkey, msat, riskFactor, strings.ToLower(fromPubkey), maxHops,
+			clnExclusions(excl),
+		}
+	default:
+		params = struct {
+			ToPubkey   string   `json:"id"`
+			AmountMsat int64    `json:"amount_msat"`
+			RiskFactor int64    `json:"riskfactor"`
+			FromPubkey string   `json:"fromid"`
+			MaxHops    int64    `json:"maxhops"`
+			Exclude    []string `json:"exclude,omitempty"`
+		}{
+			toPubkey, msat, riskFactor, strings.ToLower(fromPubkey), maxHops,
+			clnExclusions(excl),
+		}
 	}
 
-	err := lr.client.Call("getroute", params, &r)
+	err = lr.client.Call(ctx, "getroute", params, &r)
 	if err != nil {
 		return r, stackerr.Wrap(err)
 	}
@@ -81,43 +304,272 @@ func (lr *lnRouter) getRoute(toPubkey string, msat int64) (clnRoute, error) {
 	return r, nil
 }
 
-func (lr *lnRouter) getChan(scid string) ([]clnChan, error) {
+// getRouteAskrene asks the askrene plugin for a route. The exclusions are
+// given in a temporary layer, removed after the call.
+func (lr *lnRouter) getRouteAskrene(
+	ctx context.Context,
+	fromPubkey, toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) (clnRoute, error) {
+	const (
+		finalCltv = 18
+		// askrene requires a fee budget, without one from the request the
+		// fee is bounded like lnd does by default
+		defaultMaxFeePpm  = 50_000
+		defaultMaxFeeMsat = 100_000
+	)
+	var (
+		r      clnRoute
+		layers = []string{}
+	)
+	defaultFeeMsat := max(msat*defaultMaxFeePpm/1_000_000, defaultMaxFeeMsat)
+	maxFeeMsat := limits.maxFeeMsat(msat)
+	if maxFeeMsat == 0 {
+		maxFeeMsat = defaultFeeMsat
+	}
+	// the route delay counts the final cltv on top of the hop deltas
+	var maxDelay int64
+	if limits.MaxCltv > 0 {
+		maxDelay = limits.MaxCltv + finalCltv
+	}
+	if len(excl.Nodes) > 0 || len(excl.Chans) > 0 {
+		layer, err := lr.createExclusionLayer(ctx, excl)
+		if err != nil {
+			return r, stackerr.Wrap(err)
+		}
+		defer lr.removeLayer(ctx, layer)
+		layers = append(layers, layer)
+	}
+
+	type getRoutesResult struct {
+		Routes []struct {
+			Path []struct {
+				ShortChannelIdDir string  `json:"short_channel_id_dir"`
+				NextNodeId        string  `json:"next_node_id"`
+				AmountMsat        clnMsat `json:"amount_msat"`
+				Delay             int32   `json:"delay"`
+			} `json:"path"`
+		} `json:"routes"`
+	}
+	getRoutes := func(maxFeeMsat, maxDelay int64) (getRoutesResult, error) {
+		var res getRoutesResult
+		params := struct {
+			Source      string   `json:"source"`
+			Destination string   `json:"destination"`
+			AmountMsat  int64    `json:"amount_msat"`
+			Layers      []string `json:"layers"`
+			MaxFeeMsat  int64    `json:"maxfee_msat"`
+			FinalCltv   int64    `json:"final_cltv"`
+			MaxDelay    int64    `json:"maxdelay,omitempty"`
+		}{
+			strings.ToLower(fromPubkey), strings.ToLower(toPubkey), msat, layers,
+			maxFeeMsat, finalCltv, maxDelay,
+		}
+		err := lr.client.Call(ctx, "getroutes", params, &res)
+		return res, err
+	}
+	res, err := getRoutes(maxFeeMsat, maxDelay)
+	if err != nil {
+		// a route found without the limits of the request tells the search
+		// failed on the budget
+		if maxFeeMsat < defaultFeeMsat || maxDelay > 0 {
+			_, retryErr := getRoutes(max(maxFeeMsat, defaultFeeMsat), 0)
+			if retryErr == nil {
+				return r, stackerr.Wrap(errNoRouteWithinBudget)
+			}
+		}
+		return r, stackerr.Wrap(err)
+	}
+	// askrene splits the amount when no single route carries it
+	if l := len(res.Routes); l != 1 {
+		return r, stackerr.Wrap(fmt.Errorf("unexpected getroutes routes: %d", l))
+	}
+
+	for _, v := range res.Routes[0].Path {
+		scid, direction, _ := strings.Cut(v.ShortChannelIdDir, "/")
+		dir, err := strconv.Atoi(direction)
+		if err != nil {
+			return r, stackerr.Wrap(err)
+		}
+		r.Hops = append(r.Hops, clnHop{
+			NodeId:            v.NextNodeId,
+			ShortChannelId:    scid,
+			ShortChannelIdInt: mustShortChannelIdToInt(scid),
+			Direction:         dir,
+			AmountMsat:        v.AmountMsat,
+			Delay:             v.Delay,
+		})
+	}
+	return r, nil
+}
+
+func (lr *lnRouter) createExclusionLayer(
+	ctx context.Context, excl RouteExclusions,
+) (string, error) {
+	var (
+		suffix [8]byte
+		ignore json.RawMessage
+	)
+	_, err := rand.Read(suffix[:])
+	if err != nil {
+		return "", stackerr.Wrap(err)
+	}
+	layer := "golympus-" + hex.EncodeToString(suffix[:])
+
+	err = lr.client.Call(ctx, "askrene-create-layer", struct {
+		Layer string `json:"layer"`
+	}{layer}, &ignore)
+	if err != nil {
+		return "", stackerr.Wrap(err)
+	}
+	for _, nodeId := range excl.Nodes {
+		err = lr.client.Call(ctx, "askrene-disable-node", struct {
+			Layer string `json:"layer"`
+			Node  string `json:"node"`
+		}{layer, strings.ToLower(nodeId)}, &ignore)
+		if err != nil {
+			lr.removeLayer(ctx, layer)
+			return "", stackerr.Wrap(err)
+		}
+	}
+	for _, scidDir := range clnExclusions(RouteExclusions{Chans: excl.Chans}) {
+		err = lr.client.Call(ctx, "askrene-update-channel", struct {
+			Layer             string `json:"layer"`
+			ShortChannelIdDir string `json:"short_channel_id_dir"`
+			Enabled           bool   `json:"enabled"`
+		}{layer, scidDir, false}, &ignore)
+		if err != nil {
+			lr.removeLayer(ctx, layer)
+			return "", stackerr.Wrap(err)
+		}
+	}
+	return layer, nil
+}
+
+// removeLayer is done even when the request context is already done
+func (lr *lnRouter) removeLayer(ctx context.Context, layer string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*10)
+	defer cancel()
+	var ignore json.RawMessage
+	err := lr.client.Call(ctx, "askrene-remove-layer", struct {
+		Layer string `json:"layer"`
+	}{layer}, &ignore)
+	if err != nil {
+		log.Println("error removing askrene layer", layer, err)
+	}
+}
+
+// getChan returns both directions of the channel, from the policy cache when
+// available
+func (lr *lnRouter) getChan(
+	ctx context.Context, scid string,
+) ([]clnChan, error) {
+	scidInt := mustShortChannelIdToInt(scid)
+	if chans, ok := lr.policies.get(scidInt); ok {
+		return chans, nil
+	}
+
+	chans, err := lr.listChannel(ctx, scidInt)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	if l := len(chans); l != 2 {
+		return chans, fmt.Errorf("unexpected getchannels result length: %d", l)
+	}
+	lr.policies.put(scidInt, chans)
+
+	return chans, nil
+}
+
+// listChannel lists the directions of the channel with a channel update
+func (lr *lnRouter) listChannel(ctx context.Context, scid int64) ([]clnChan, error) {
 	var r struct {
 		Channels []clnChan `json:"channels"`
 	}
 	params := struct {
 		ShortChannelId string `json:"short_channel_id"`
-	}{scid}
+	}{shortChannelIdToString(scid)}
+	err := lr.client.Call(ctx, "listchannels", params, &r)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return r.Channels, nil
+}
 
-	err := lr.client.Call("listchannels", params, &r)
+func (lr *lnRouter) listChannels(ctx context.Context) ([]clnChan, error) {
+	var r struct {
+		Channels []clnChan `json:"channels"`
+	}
+	err := lr.client.Call(ctx, "listchannels", struct{}{}, &r)
 	if err != nil {
-		return r.Channels, stackerr.Wrap(err)
+		return nil, stackerr.Wrap(err)
+	}
+	for _, c := range r.Channels {
+		lr.policies.observeUpdate(
+			mustShortChannelIdToInt(c.ShortChannelId), c.LastUpdate,
+		)
 	}
+	return r.Channels, nil
+}
 
-	if l := len(r.Channels); l != 2 {
-		return r.Channels, fmt.Errorf("unexpected getchannels result length: %d", l)
+func (lr *lnRouter) inboundChannels(ctx context.Context, nodeId string) ([]Hop, error) {
+	var r struct {
+		Channels []clnChan `json:"channels"`
 	}
+	params := struct {
+		Destination string `json:"destination"`
+	}{nodeId}
+	err := lr.client.Call(ctx, "listchannels", params, &r)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	hops := make([]Hop, 0, len(r.Channels))
+	for _, c := range r.Channels {
+		hops = append(hops, clnChanToEdge(c).toHop())
+	}
+	return hops, nil
+}
 
-	return r.Channels, nil
+func (lr *lnRouter) listNodes(ctx context.Context) ([]clnNode, error) {
+	var r struct {
+		Nodes []clnNode `json:"nodes"`
+	}
+	err := lr.client.Call(ctx, "listnodes", struct{}{}, &r)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return r.Nodes, nil
+}
+
+// clnExclusions translates the exclusions to the getroute format, where
+// channels are given as scid/direction and nodes by their id
+func clnExclusions(excl RouteExclusions) []string {
+	var r []string
+	for _, scid := range excl.Chans {
+		scidStr := shortChannelIdToString(scid)
+		r = append(r, scidStr+"/0", scidStr+"/1")
+	}
+	for _, nodeId := range excl.Nodes {
+		r = append(r, strings.ToLower(nodeId))
+	}
+	return r
 }
 
+// clnDataToPaymentRoute builds the payment route starting at fromPubkey, the
+// node that forwards through the first channel of the route
 func clnDataToPaymentRoute(
-	clnRoute clnRoute, clnChans map[int64][]clnChan,
+	fromPubkey string, clnRoute clnRoute, clnChans map[int64][]clnChan,
 ) PaymentRoute {
 
 	hops := []Hop{}
 	for i, clnHop := range clnRoute.Hops {
 		var hop Hop
 
-		// in the first hop we don't know previous node id (id of this node)
-		// let's discover it
-		if i == 0 &&
-			clnChans[clnHop.ShortChannelIdInt][0].Destination == clnHop.NodeId {
-			hop.NodeId = clnChans[clnHop.ShortChannelIdInt][0].Source
-		} else if i == 0 {
-			hop.NodeId = clnChans[clnHop.ShortChannelIdInt][0].Destination
+		if i == 0 {
+			hop.NodeId = strings.ToLower(fromPubkey)
 		} else {
-			// we are sure there's a previous hop
 			hop.NodeId = clnRoute.Hops[i-1].NodeId
 		}
 
@@ -131,9 +583,12 @@ func clnDataToPaymentRoute(
 		}
 
 		hop.CltvExpiryDelta = int16(sourceChan.Delay)
-		hop.HtlcMinimumMsat = msatWithSuffixToInt(sourceChan.HtlcMinMsat)
+		hop.HtlcMinimumMsat = int64(sourceChan.HtlcMinMsat)
 		hop.FeeBaseMsat = int32(sourceChan.BaseFeeMsat)
 		hop.FeeProportionalMillionths = int32(sourceChan.FeePerMillionth)
+		hop.HtlcMaximumMsat = int64(sourceChan.HtlcMaxMsat)
+		hop.Disabled = !sourceChan.Active
+		hop.Features = sourceChan.Features
 
 		hops = append(hops, hop)
 	}
@@ -141,14 +596,56 @@ func clnDataToPaymentRoute(
 	return hops
 }
 
-func msatWithSuffixToInt(in string) int64 {
-	s, _ := strings.CutSuffix(in, "msat")
+// clnSchema is the routing api and amount format of a CLN version
+type clnSchema int
+
+const (
+	// before v23.02, amounts as "msatoshi" and strings with "msat" suffix
+	clnSchemaLegacy clnSchema = iota
+	// amounts as "amount_msat" integers
+	clnSchemaAmountMsat
+	// since v24.11, getroutes from the askrene plugin, with layers
+	clnSchemaAskrene
+)
+
+// clnSchemaFromVersion parses versions like "v24.11.1-modded". Unparseable
+// versions are taken as recent.
+func clnSchemaFromVersion(version string) clnSchema {
+	version = strings.TrimPrefix(version, "v")
+	parts := strings.FieldsFunc(version, func(r rune) bool {
+		return r == '.' || r == '-'
+	})
+	if len(parts) < 2 {
+		return clnSchemaAskrene
+	}
+	major, errMajor := strconv.Atoi(parts[0])
+	minor, errMinor := strconv.Atoi(parts[1])
+	if errMajor != nil || errMinor != nil {
+		return clnSchemaAskrene
+	}
+	switch {
+	case major > 24 || (major == 24 && minor >= 11):
+		return clnSchemaAskrene
+	case major > 23 || (major == 23 && minor >= 2):
+		return clnSchemaAmountMsat
+	default:
+		return clnSchemaLegacy
+	}
+}
+
+// clnMsat decodes both the integer msat amounts and the legacy strings with
+// "msat" suffix
+type clnMsat int64
+
+func (m *clnMsat) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	s, _ = strings.CutSuffix(s, "msat")
 	r, err := strconv.ParseInt(s, 10, 64)
-	// must never fail
 	if err != nil {
-		panic(stackerr.Wrap(err))
+		return stackerr.Wrap(err)
 	}
-	return r
+	*m = clnMsat(r)
+	return nil
 }
 
 type PaymentRoute []Hop
@@ -160,6 +657,10 @@ type Hop struct {
 	HtlcMinimumMsat           int64  `json:"htlcMinimumMsat"`
 	FeeBaseMsat               int32  `json:"feeBaseMsat"`
 	FeeProportionalMillionths int32  `json:"feeProportionalMillionths"`
+	HtlcMaximumMsat           int64  `json:"htlcMaximumMsat"`
+	Disabled                  bool   `json:"disabled"`
+	// Features are the channel features, hex encoded
+	Features string `json:"features"`
 }
 
 type clnRoute struct {
@@ -170,17 +671,28 @@ type clnHop struct {
 	NodeId            string `json:"id"`
 	ShortChannelId    string `json:"channel"`
 	ShortChannelIdInt int64
-	AmountMsat        int64 `json:"msatoshi"`
-	Delay             int32 `json:"delay"`
+	Direction         int     `json:"direction"`
+	AmountMsat        clnMsat `json:"amount_msat"`
+	Delay             int32   `json:"delay"`
 }
 
 type clnChan struct {
-	Source          string `json:"source"`
-	Destination     string `json:"destination"`
-	ShortChannelId  string `json:"short_channel_id"`
-	BaseFeeMsat     int64  `json:"base_fee_millisatoshi"`
-	FeePerMillionth int64  `json:"fee_per_millionth"`
-	Delay           int32  `json:"delay"`
-	HtlcMinMsat     string `json:"htlc_minimum_msat"`
-	HtlcMaxMsat     string `json:"htlc_maximum_msat"`
+	Source          string  `json:"source"`
+	Destination     string  `json:"destination"`
+	ShortChannelId  string  `json:"short_channel_id"`
+	BaseFeeMsat     int64   `json:"base_fee_millisatoshi"`
+	FeePerMillionth int64   `json:"fee_per_millionth"`
+	Delay           int32   `json:"delay"`
+	HtlcMinMsat     clnMsat `json:"htlc_minimum_msat"`
+	HtlcMaxMsat     clnMsat `json:"htlc_maximum_msat"`
+	AmountMsat      clnMsat `json:"amount_msat"`
+	Active          bool    `json:"active"`
+	LastUpdate      int64   `json:"last_update"`
+	Features        string  `json:"features"`
+}
+
+type clnNode struct {
+	NodeId        string `json:"nodeid"`
+	Alias         string `json:"alias"`
+	LastTimestamp int64  `json:"last_timestamp"`
 }
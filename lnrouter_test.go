@@ -1,21 +1,52 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"sync"
 	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
 )
 
 func Test_clnDataToPaymentRoute(t *testing.T) {
 	tData := clnDataToPaymentRoutePayloadData()
 
-	r := clnDataToPaymentRoute(tData.route, tData.chans)
+	r := clnDataToPaymentRoute(tData.from, tData.route, tData.chans)
 
 	if !reflect.DeepEqual(tData.expected, r) {
 		t.Fatalf("expecting: %+v\ngot: %+v\n", tData.expected, r)
 	}
 }
 
+func Test_clnExclusions(t *testing.T) {
+	excl := RouteExclusions{
+		Nodes: []string{
+			"02AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+		},
+		Chans: []int64{556369376388317185},
+	}
+	expected := []string{
+		"506015x904x1/0",
+		"506015x904x1/1",
+		"02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+	}
+
+	r := clnExclusions(excl)
+
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+}
+
 type testPayload struct {
+	from     string
 	route    clnRoute
 	chans    map[int64][]clnChan
 	expected PaymentRoute
@@ -56,8 +87,9 @@ func clnDataToPaymentRoutePayloadData() testPayload {
 				BaseFeeMsat:     0,
 				FeePerMillionth: 450,
 				Delay:           34,
-				HtlcMinMsat:     "1msat",
-				HtlcMaxMsat:     "2070588000msat",
+				HtlcMinMsat:     1,
+				HtlcMaxMsat:     2070588000,
+				Active:          true,
 			},
 			{
 				Source:          "02bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
@@ -66,8 +98,9 @@ func clnDataToPaymentRoutePayloadData() testPayload {
 				BaseFeeMsat:     1000,
 				FeePerMillionth: 100,
 				Delay:           34,
-				HtlcMinMsat:     "1msat",
-				HtlcMaxMsat:     "2070588000msat",
+				HtlcMinMsat:     1,
+				HtlcMaxMsat:     2070588000,
+				Active:          true,
 			},
 		},
 		{
@@ -78,8 +111,9 @@ func clnDataToPaymentRoutePayloadData() testPayload {
 				BaseFeeMsat:     0,
 				FeePerMillionth: 450,
 				Delay:           34,
-				HtlcMinMsat:     "1msat",
-				HtlcMaxMsat:     "6930000000msat",
+				HtlcMinMsat:     1,
+				HtlcMaxMsat:     6930000000,
+				Active:          true,
 			},
 			{
 				Source:          "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
@@ -88,8 +122,9 @@ func clnDataToPaymentRoutePayloadData() testPayload {
 				BaseFeeMsat:     0,
 				FeePerMillionth: 3000,
 				Delay:           210,
-				HtlcMinMsat:     "1000msat",
-				HtlcMaxMsat:     "21049000msat",
+				HtlcMinMsat:     1000,
+				HtlcMaxMsat:     21049000,
+				Active:          true,
 			},
 		},
 		{
@@ -100,8 +135,9 @@ func clnDataToPaymentRoutePayloadData() testPayload {
 				BaseFeeMsat:     1000,
 				FeePerMillionth: 1,
 				Delay:           80,
-				HtlcMinMsat:     "1000msat",
-				HtlcMaxMsat:     "9900000000msat",
+				HtlcMinMsat:     1000,
+				HtlcMaxMsat:     9900000000,
+				Active:          true,
 			},
 			{
 				Source:          "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
@@ -110,8 +146,9 @@ func clnDataToPaymentRoutePayloadData() testPayload {
 				BaseFeeMsat:     0,
 				FeePerMillionth: 3000,
 				Delay:           210,
-				HtlcMinMsat:     "1000msat",
-				HtlcMaxMsat:     "8117000msat",
+				HtlcMinMsat:     1000,
+				HtlcMaxMsat:     8117000,
+				Active:          true,
 			},
 		},
 	}
@@ -130,6 +167,7 @@ func clnDataToPaymentRoutePayloadData() testPayload {
 			HtlcMinimumMsat:           1,
 			FeeBaseMsat:               1000,
 			FeeProportionalMillionths: 100,
+			HtlcMaximumMsat:           2070588000,
 		},
 		{
 			NodeId:                    "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
@@ -138,6 +176,7 @@ func clnDataToPaymentRoutePayloadData() testPayload {
 			HtlcMinimumMsat:           1,
 			FeeBaseMsat:               0,
 			FeeProportionalMillionths: 450,
+			HtlcMaximumMsat:           6930000000,
 		},
 		{
 			NodeId:                    "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
@@ -146,12 +185,233 @@ func clnDataToPaymentRoutePayloadData() testPayload {
 			HtlcMinimumMsat:           1000,
 			FeeBaseMsat:               0,
 			FeeProportionalMillionths: 3000,
+			HtlcMaximumMsat:           8117000,
 		},
 	}
 
 	return testPayload{
+		from:     "02bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
 		route:    clnRoute{routePayload},
 		chans:    channelsMapPayload,
 		expected: expected,
 	}
 }
+
+func Test_clnSchemaFromVersion(t *testing.T) {
+	payload := map[string]clnSchema{
+		"v0.12.1":           clnSchemaLegacy,
+		"v23.02":            clnSchemaAmountMsat,
+		"v24.08.2":          clnSchemaAmountMsat,
+		"v24.11":            clnSchemaAskrene,
+		"v25.02.1-modded":   clnSchemaAskrene,
+		"v23.11-48-gf7a4e6": clnSchemaAmountMsat,
+	}
+
+	for version, expected := range payload {
+		r := clnSchemaFromVersion(version)
+		if r != expected {
+			t.Fatalf("unexpected schema for %s: %d", version, r)
+		}
+	}
+}
+
+func Test_clnMsatUnmarshal(t *testing.T) {
+	var r struct {
+		Legacy clnMsat `json:"legacy"`
+		Int    clnMsat `json:"int"`
+	}
+	payload := `{"legacy": "2070588000msat", "int": 2070588000}`
+
+	tu.Must(t, json.Unmarshal([]byte(payload), &r))
+
+	if r.Legacy != 2070588000 || r.Int != 2070588000 {
+		t.Fatalf("unexpected: %+v", r)
+	}
+}
+
+// fakeCln answers getinfo, getroute, listchannels and listnodes over a
+// single channel
+// between from and to, with feeBase as the policy of from. The probes fail at
+// the destination once released.
+type fakeCln struct {
+	mu         sync.Mutex
+	from, to   string
+	feeBase    int64
+	lastUpdate int64
+	waiting    chan struct{}
+	release    chan struct{}
+}
+
+func (f *fakeCln) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				var req struct {
+					Id     int64  `json:"id"`
+					Method string `json:"method"`
+				}
+				line, err := r.ReadBytes('\n')
+				if err != nil || json.Unmarshal(line, &req) != nil {
+					return
+				}
+				res, _ := json.Marshal(f.response(req.Id, req.Method))
+				conn.Write(append(res, '\n', '\n'))
+			}
+		}()
+	}
+}
+
+func (f *fakeCln) response(id int64, method string) map[string]interface{} {
+	if method == "waitsendpay" {
+		f.waiting <- struct{}{}
+		<-f.release
+		return map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      id,
+			"error": map[string]interface{}{
+				"code":    clnPayDestinationPermFail,
+				"message": "WIRE_INCORRECT_OR_UNKNOWN_PAYMENT_DETAILS",
+				"data": clnPayFailure{
+					ErringIndex: 1,
+					Failcode:    failcodeIncorrectOrUnknownPaymentHash,
+				},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"result":  f.result(method),
+	}
+}
+
+func (f *fakeCln) result(method string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch method {
+	case "getinfo":
+		return map[string]string{"id": f.from, "version": "v24.08"}
+	case "getroute":
+		return clnRoute{[]clnHop{{
+			NodeId: f.to, ShortChannelId: "877236x1111x0",
+			AmountMsat: 1000000, Delay: 18,
+		}}}
+	case "listchannels":
+		c := clnChan{
+			Source: f.from, Destination: f.to, ShortChannelId: "877236x1111x0",
+			BaseFeeMsat: f.feeBase, Delay: 40, HtlcMaxMsat: 100000000,
+			Active: true, LastUpdate: f.lastUpdate,
+		}
+		reverse := c
+		reverse.Source, reverse.Destination = f.to, f.from
+		return map[string][]clnChan{"channels": {c, reverse}}
+	case "listnodes":
+		return map[string][]clnNode{"nodes": {{NodeId: f.from, Alias: "A"}}}
+	}
+	return struct{}{}
+}
+
+func (f *fakeCln) update(feeBase int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.feeBase = feeBase
+	f.lastUpdate++
+}
+
+func Test_lnRouterPollPolicies(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "lightning-rpc")
+	l, err := net.Listen("unix", address)
+	tu.Must(t, err)
+	defer l.Close()
+	f := &fakeCln{
+		from:       "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		to:         "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+		feeBase:    1000,
+		lastUpdate: 1700000000,
+	}
+	go f.serve(l)
+
+	ctx := context.Background()
+	lr := NewLnRouter("unix", address, 2, 1, time.Hour, 0)
+	defer lr.Close()
+	feeBase := func() int32 {
+		routes, err := lr.FindRoutes(ctx, nil, f.to, 1000000, RouteExclusions{}, RouteLimits{})
+		tu.Must(t, err)
+		return routes[0][0].FeeBaseMsat
+	}
+
+	if r := feeBase(); r != 1000 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 1000, r)
+	}
+	f.update(2000)
+	// still cached until the poll sees the newer update
+	if r := feeBase(); r != 1000 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 1000, r)
+	}
+	tu.Must(t, lr.pollPolicies(ctx))
+	if r := feeBase(); r != 2000 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 2000, r)
+	}
+}
+
+func Test_lnRouterNodeStats(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "lightning-rpc")
+	l, err := net.Listen("unix", address)
+	tu.Must(t, err)
+	defer l.Close()
+	f := &fakeCln{
+		from:    "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		to:      "03cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+		feeBase: 1000,
+	}
+	go f.serve(l)
+
+	ctx := context.Background()
+	lr := NewLnRouter("unix", address, 2, 1, time.Hour, 0)
+	defer lr.Close()
+	var _ nodeStatsLister = lr
+
+	r, err := lr.nodeStats(ctx)
+	tu.Must(t, err)
+	if len(r) != 2 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 2, len(r))
+	}
+	i := slices.IndexFunc(r, func(s nodeStats) bool { return s.NodeId == f.from })
+	expected := nodeStats{
+		NodeId:       f.from,
+		Alias:        "A",
+		NumPeers:     1,
+		NumChannels:  1,
+		MedianFeePpm: 10,
+		Uptime:       1,
+	}
+	if i < 0 || !reflect.DeepEqual(expected, r[i]) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	// the graph is not listed again on each request
+	f.update(2000)
+	r, err = lr.nodeStats(ctx)
+	tu.Must(t, err)
+	i = slices.IndexFunc(r, func(s nodeStats) bool { return s.NodeId == f.from })
+	if i < 0 || r[i].MedianFeePpm != 10 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 10, r)
+	}
+	// while a request lists the graph, the others use the previous listing
+	lr.statsMu.Lock()
+	lr.statsListing = true
+	lr.statsListedAt = time.Now().Add(-time.Hour)
+	lr.statsMu.Unlock()
+	r, err = lr.nodeStats(ctx)
+	tu.Must(t, err)
+	i = slices.IndexFunc(r, func(s nodeStats) bool { return s.NodeId == f.from })
+	if i < 0 || r[i].MedianFeePpm != 10 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 10, r)
+	}
+}
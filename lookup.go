@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"master.private/bstd.git/stackerr"
+)
+
+var (
+	errUnknownChannel        = errors.New("unknown channel")
+	errUnknownNode           = errors.New("unknown node")
+	errInvalidShortChannelId = errors.New("invalid short channel id")
+	errInvalidNodeId         = errors.New("invalid node id")
+	errLookupUnsupported     = errors.New("lookups unsupported by the lightning backend")
+)
+
+// graphLookup describes the channels and nodes appearing in payment
+// failures
+type graphLookup interface {
+	lookupChannel(ctx context.Context, scid int64) (channelInfo, error)
+	lookupNode(ctx context.Context, nodeId string) (nodeInfo, error)
+}
+
+type channelInfo struct {
+	ShortChannelId    string `json:"shortChannelId"`
+	ShortChannelIdInt int64  `json:"shortChannelIdInt"`
+	CapacityMsat      int64  `json:"capacityMsat"`
+	// Policies has the policy of each direction with a channel update,
+	// direction 0 first
+	Policies []channelPolicy `json:"policies"`
+}
+
+type channelPolicy struct {
+	Source                    string `json:"source"`
+	Destination               string `json:"destination"`
+	Direction                 int    `json:"direction"`
+	FeeBaseMsat               int32  `json:"feeBaseMsat"`
+	FeeProportionalMillionths int32  `json:"feeProportionalMillionths"`
+	CltvExpiryDelta           int16  `json:"cltvExpiryDelta"`
+	HtlcMinimumMsat           int64  `json:"htlcMinimumMsat"`
+	HtlcMaximumMsat           int64  `json:"htlcMaximumMsat"`
+	Disabled                  bool   `json:"disabled"`
+	LastUpdate                int64  `json:"lastUpdate"`
+	Features                  string `json:"features"`
+}
+
+type nodeInfo struct {
+	NodeId     string        `json:"nodeId"`
+	Alias      string        `json:"alias"`
+	Color      string        `json:"color"`
+	Features   string        `json:"features"`
+	Addresses  []nodeAddress `json:"addresses"`
+	LastUpdate int64         `json:"lastUpdate"`
+}
+
+type nodeAddress struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Port    int64  `json:"port"`
+}
+
+// newChannelInfo describes the channel from its directed edges
+func newChannelInfo(scid int64, edges []*graphEdge) (channelInfo, error) {
+	if len(edges) == 0 {
+		return channelInfo{}, stackerr.Wrap(errUnknownChannel)
+	}
+	r := channelInfo{
+		ShortChannelId:    shortChannelIdToString(scid),
+		ShortChannelIdInt: scid,
+		Policies:          make([]channelPolicy, 0, len(edges)),
+	}
+	for _, e := range edges {
+		r.CapacityMsat = max(r.CapacityMsat, e.CapacityMsat)
+		r.Policies = append(r.Policies, channelPolicy{
+			Source:                    e.Source,
+			Destination:               e.Destination,
+			Direction:                 channelDirection(e.Source, e.Destination),
+			FeeBaseMsat:               e.FeeBaseMsat,
+			FeeProportionalMillionths: e.FeeProportionalMillionths,
+			CltvExpiryDelta:           e.CltvExpiryDelta,
+			HtlcMinimumMsat:           e.HtlcMinimumMsat,
+			HtlcMaximumMsat:           e.HtlcMaximumMsat,
+			Disabled:                  e.Disabled,
+			LastUpdate:                e.LastUpdate,
+			Features:                  e.Features,
+		})
+	}
+	if len(r.Policies) == 2 && r.Policies[0].Direction == 1 {
+		r.Policies[0], r.Policies[1] = r.Policies[1], r.Policies[0]
+	}
+	return r, nil
+}
+
+func (lr *lnRouter) lookupChannel(ctx context.Context, scid int64) (channelInfo, error) {
+	chans, err := lr.listChannel(ctx, scid)
+	if err != nil {
+		return channelInfo{}, stackerr.Wrap(err)
+	}
+	edges := make([]*graphEdge, 0, len(chans))
+	for _, c := range chans {
+		edges = append(edges, clnChanToEdge(c))
+	}
+	info, err := newChannelInfo(scid, edges)
+	if err != nil {
+		return channelInfo{}, stackerr.Wrap(err)
+	}
+	return info, nil
+}
+
+func (lr *lnRouter) lookupNode(ctx context.Context, nodeId string) (nodeInfo, error) {
+	var r struct {
+		Nodes []struct {
+			NodeId        string        `json:"nodeid"`
+			Alias         string        `json:"alias"`
+			Color         string        `json:"color"`
+			Features      string        `json:"features"`
+			Addresses     []nodeAddress `json:"addresses"`
+			LastTimestamp int64         `json:"last_timestamp"`
+		} `json:"nodes"`
+	}
+	params := struct {
+		Id string `json:"id"`
+	}{nodeId}
+	err := lr.client.Call(ctx, "listnodes", params, &r)
+	if err != nil {
+		return nodeInfo{}, stackerr.Wrap(err)
+	}
+	if len(r.Nodes) == 0 {
+		return nodeInfo{}, stackerr.Wrap(errUnknownNode)
+	}
+	n := r.Nodes[0]
+	return nodeInfo{
+		NodeId:     n.NodeId,
+		Alias:      n.Alias,
+		Color:      n.Color,
+		Features:   n.Features,
+		Addresses:  n.Addresses,
+		LastUpdate: n.LastTimestamp,
+	}, nil
+}
+
+// lookupChannel asks the graph source when able to, the in memory graph
+// otherwise
+func (gr *graphRouter) lookupChannel(ctx context.Context, scid int64) (channelInfo, error) {
+	if gl, ok := gr.source.(graphLookup); ok {
+		info, err := gl.lookupChannel(ctx, scid)
+		if err != nil {
+			return channelInfo{}, stackerr.Wrap(err)
+		}
+		return info, nil
+	}
+	info, err := newChannelInfo(scid, gr.graph.channelEdges(scid))
+	if err != nil {
+		return channelInfo{}, stackerr.Wrap(err)
+	}
+	return info, nil
+}
+
+// lookupNode asks the graph source when able to, the in memory graph
+// otherwise, which has neither the node features nor its addresses
+func (gr *graphRouter) lookupNode(ctx context.Context, nodeId string) (nodeInfo, error) {
+	if gl, ok := gr.source.(graphLookup); ok {
+		info, err := gl.lookupNode(ctx, nodeId)
+		if err != nil {
+			return nodeInfo{}, stackerr.Wrap(err)
+		}
+		return info, nil
+	}
+	node, ok := gr.graph.node(nodeId)
+	if !ok {
+		return nodeInfo{}, stackerr.Wrap(errUnknownNode)
+	}
+	return nodeInfo{
+		NodeId:     node.Id,
+		Alias:      node.Alias,
+		LastUpdate: node.LastUpdate,
+	}, nil
+}
+
+// channelEdges returns the edges of the channel, direction 0 first
+func (g *channelGraph) channelEdges(scid int64) []*graphEdge {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var r []*graphEdge
+	for direction := range 2 {
+		if e, ok := g.edges[edgeKey{scid, direction}]; ok {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+func (g *channelGraph) node(nodeId string) (graphNode, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	node, ok := g.nodes[strings.ToLower(nodeId)]
+	return node, ok
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_parseShortChannelId(t *testing.T) {
+	for _, v := range []string{"506015x904x1", "556369376388317185"} {
+		r, err := parseShortChannelId(v)
+		tu.Must(t, err)
+		if r != 556369376388317185 {
+			t.Fatalf("expecting: %+v\ngot: %+v\n", 556369376388317185, r)
+		}
+	}
+	for _, v := range []string{"", "506015x904", "506015x904x65536", "-1", "abc"} {
+		_, err := parseShortChannelId(v)
+		if err == nil {
+			t.Fatal("expecting an error for", v)
+		}
+	}
+}
+
+func Test_graphRouterLookupChannel(t *testing.T) {
+	const (
+		a = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		b = "02bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	)
+	newChan := func(source, destination string, feeBase int64) clnChan {
+		return clnChan{
+			Source:          source,
+			Destination:     destination,
+			ShortChannelId:  "506015x904x1",
+			BaseFeeMsat:     feeBase,
+			FeePerMillionth: 100,
+			Delay:           40,
+			HtlcMinMsat:     1,
+			HtlcMaxMsat:     1000000000,
+			AmountMsat:      1000000000,
+			Active:          true,
+			LastUpdate:      1700000000,
+		}
+	}
+	gr := &graphRouter{graph: newChannelGraph(), source: &fileGraphSource{}}
+	gr.graph.applyChannels([]clnChan{newChan(b, a, 2000), newChan(a, b, 1000)})
+
+	ctx := context.Background()
+	r, err := gr.lookupChannel(ctx, 556369376388317185)
+	tu.Must(t, err)
+	policy := channelPolicy{
+		Source:                    a,
+		Destination:               b,
+		FeeBaseMsat:               1000,
+		FeeProportionalMillionths: 100,
+		CltvExpiryDelta:           40,
+		HtlcMinimumMsat:           1,
+		HtlcMaximumMsat:           1000000000,
+		LastUpdate:                1700000000,
+	}
+	reverse := policy
+	reverse.Source, reverse.Destination, reverse.Direction = b, a, 1
+	reverse.FeeBaseMsat = 2000
+	expected := channelInfo{
+		ShortChannelId:    "506015x904x1",
+		ShortChannelIdInt: 556369376388317185,
+		CapacityMsat:      1000000000,
+		Policies:          []channelPolicy{policy, reverse},
+	}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	_, err = gr.lookupChannel(ctx, 1)
+	if !errors.Is(err, errUnknownChannel) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", errUnknownChannel, err)
+	}
+}
+
+type staticGraphLookup map[string]nodeInfo
+
+func (s staticGraphLookup) lookupChannel(_ context.Context, _ int64) (channelInfo, error) {
+	return channelInfo{}, errUnknownChannel
+}
+
+func (s staticGraphLookup) lookupNode(_ context.Context, nodeId string) (nodeInfo, error) {
+	info, ok := s[nodeId]
+	if !ok {
+		return nodeInfo{}, errUnknownNode
+	}
+	return info, nil
+}
+
+func Test_nodeHandler(t *testing.T) {
+	const a = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	gl := staticGraphLookup{a: {NodeId: a, Alias: "A", Addresses: []nodeAddress{
+		{"ipv4", "127.0.0.1", 9735},
+	}}}
+	s := newServer(nil, nil, nil, nil, nil, gl, time.Second, 3, 0, 0, "")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /router/node/{id}", httpErrMdw(s.nodeHandler))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/router/node/"+strings.ToUpper(a), nil))
+	expected := `["ok",{"nodeId":"` + a + `","alias":"A","color":"","features":"",` +
+		`"addresses":[{"type":"ipv4","address":"127.0.0.1","port":9735}],"lastUpdate":0}]` + "\n"
+	if !reflect.DeepEqual(expected, w.Body.String()) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/router/node/"+strings.Replace(a, "a", "b", -1), nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusNotFound, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/router/node/02aa", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusBadRequest, w.Code)
+	}
+}
@@ -22,11 +22,43 @@ func main() {
 	fmt.Fprintln(os.Stderr, "golympus", version, "by theBitcoinheiro")
 	pf := NewPriceFetcher()
 	ff := NewFeerateFetcher(cfg.BtcUrl, cfg.BtcUser, cfg.BtcPassword)
-	lr := NewLnRouter(cfg.LnNetwork, cfg.LnAddress)
-	srv := newServer(pf, ff, lr)
+	base, prober := newRouteFinder()
+	// the backend channel graph, when there is one, also serves the blinded
+	// paths, the lookups and the node recommendations
+	il, _ := base.(inboundChannelLister)
+	gl, _ := base.(graphLookup)
+	var nr *nodeRecommender
+	if lister, ok := base.(nodeStatsLister); ok {
+		nr = NewNodeRecommender(lister, cfg.LnBlockedNodes)
+	}
+	var rf RouteFinder = NewMissionRouter(
+		base, cfg.LnMissionControlPath, cfg.LnMissionControlHalfLife,
+	)
+	if cfg.LnRouteCacheTtl > 0 {
+		rf = NewCachingRouter(rf, cfg.LnRouteCacheTtl, cfg.LnTimeout)
+	}
+	if cfg.LnProbeBudget > 0 {
+		if prober == nil {
+			panic("probing needs the cln backend")
+		}
+		rf = NewProbingRouter(rf, prober, cfg.LnProbeInterval, cfg.LnProbeBudget)
+	}
+	srv := newServer(
+		pf, ff, rf, il, nr, gl, cfg.LnTimeout, cfg.LnMaxRoutes,
+		cfg.LnMppMinShardSat*1000, cfg.LnMppMaxParts, cfg.ReportClientHeader,
+	)
 
 	http.HandleFunc("POST /rates/get", httpErrMdw(srv.ratesHandler))
 	http.HandleFunc("POST /router/routesplus", httpErrMdw(srv.routesplusHandler))
+	http.HandleFunc("POST /router/invoiceroutes", httpErrMdw(srv.invoiceRoutesHandler))
+	http.HandleFunc("POST /router/report", httpErrMdw(srv.reportHandler))
+	http.HandleFunc("GET /router/channel/{id}", httpErrMdw(srv.channelHandler))
+	http.HandleFunc("GET /router/node/{id}", httpErrMdw(srv.nodeHandler))
+	http.HandleFunc("POST /v2/router/routes", httpErrMdw(srv.routesV2Handler))
+	http.HandleFunc("POST /v2/router/trampoline", httpErrMdw(srv.trampolineV2Handler))
+	http.HandleFunc("POST /v2/router/blindedpaths", httpErrMdw(srv.blindedPathsV2Handler))
+	http.HandleFunc("GET /v2/router/recommendednodes", httpErrMdw(srv.recommendedNodesV2Handler))
+	http.HandleFunc("GET /stats", httpErrMdw(srv.statsHandler))
 	//http.HandleFunc("POST /router/routesplus", srv.hardcodedRoutesPlus)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("%s request on %s\n", r.Method, r.URL.Path)
@@ -36,6 +68,56 @@ func main() {
 	http.ListenAndServe(cfg.ListenAddr, nil)
 }
 
+// newRouteFinder builds the RouteFinder for the configured lightning backend
+// and pathfinding mode, along with the prober of the backends able to probe
+func newRouteFinder() (RouteFinder, routeProber) {
+	switch cfg.LnBackend {
+	case "cln":
+		lr := NewLnRouter(
+			cfg.LnNetwork,
+			cfg.LnAddress,
+			cfg.LnPoolSize,
+			cfg.LnMaxRoutes,
+			cfg.LnPolicyCacheTtl,
+			cfg.LnPolicyPollInterval,
+		)
+		switch cfg.LnPathfinding {
+		case "node":
+			return lr, lr
+		case "local":
+			return NewGraphRouter(
+				lr, cfg.LnMaxRoutes, cfg.LnGraphRefresh, cfg.LnGraphFullRefresh,
+			), lr
+		}
+	case "lnd":
+		if cfg.LnPathfinding == "node" {
+			return NewLndRouter(
+				cfg.LnAddress,
+				cfg.LndMacaroonPath,
+				cfg.LndTlsCertPath,
+				cfg.LnMaxRoutes,
+			), nil
+		}
+	case "eclair":
+		if cfg.LnPathfinding == "node" {
+			return NewEclairRouter(
+				cfg.LnAddress, cfg.EclairPassword, cfg.LnMaxRoutes,
+			), nil
+		}
+	case "file":
+		// the graph of the file is always searched locally
+		return NewFileRouter(
+			cfg.LnAddress, cfg.LnFileNodeId, cfg.LnMaxRoutes, cfg.LnGraphFullRefresh,
+		), nil
+	default:
+		panic("invalid LN_BACKEND: " + cfg.LnBackend)
+	}
+	panic(fmt.Sprintf(
+		"invalid LN_PATHFINDING for %s backend: %s",
+		cfg.LnBackend, cfg.LnPathfinding,
+	))
+}
+
 func httpErrMdw(fn appHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := fn(w, r)
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// payment outcomes reported by wallets, named after the onion failure
+// messages
+const (
+	outcomeSuccess                 = "success"
+	outcomeTemporaryChannelFailure = "temporary_channel_failure"
+	outcomeChannelDisabled         = "channel_disabled"
+	outcomeUnknownNextPeer         = "unknown_next_peer"
+	outcomePermanentChannelFailure = "permanent_channel_failure"
+	outcomeFeeInsufficient         = "fee_insufficient"
+	outcomeIncorrectCltvExpiry     = "incorrect_cltv_expiry"
+	outcomeAmountBelowMinimum      = "amount_below_minimum"
+)
+
+var errUnknownOutcome = errors.New("unknown payment outcome")
+
+// PaymentOutcome is the result of forwarding a payment through a channel
+type PaymentOutcome struct {
+	ShortChannelId int64  `json:"scid"`
+	Direction      int    `json:"direction"`
+	AmountMsat     int64  `json:"amountMsat"`
+	Result         string `json:"result"`
+}
+
+// OutcomeReporter is implemented by the components learning from payment
+// outcomes. The reporter identifies the source of the outcomes, telling
+// independent reports apart.
+type OutcomeReporter interface {
+	ReportOutcomes(reporter string, outcomes []PaymentOutcome) error
+}
+
+// policyInvalidator is implemented by the route finders caching channel
+// policies, to drop a policy known to be outdated
+type policyInvalidator interface {
+	invalidatePolicy(scid int64)
+}
+
+// channelHistory is what was learned of a channel direction. A failure with
+// no amount applies to any amount. FailReporters are the distinct reporters
+// of the recent failures, up to minFailReporters.
+type channelHistory struct {
+	FailAt        time.Time `json:"failAt"`
+	FailMsat      int64     `json:"failMsat"`
+	FailReporters []string  `json:"failReporters,omitempty"`
+	SuccessAt     time.Time `json:"successAt"`
+	SuccessMsat   int64     `json:"successMsat"`
+}
+
+// missionControl estimates the success probability of channels from the
+// reported payment outcomes. What is learned fades with the half life, back
+// to the a priori probability. Without path, nothing is persisted.
+type missionControl struct {
+	mu        sync.Mutex
+	saveMu    sync.Mutex
+	path      string
+	halfLife  time.Duration
+	histories map[edgeKey]channelHistory
+	nReports  int64
+	// dirty is set by the reports not saved yet
+	dirty bool
+}
+
+const (
+	aprioriProbability = 0.6
+	successProbability = 0.95
+	// minFailReporters is how many distinct reporters must report a channel
+	// failure for the channel to be excluded, fewer only lowering the rank of
+	// its routes. The reporters are unauthenticated client addresses, so this
+	// only keeps a few honest but mistaken wallets from excluding a channel,
+	// not an attacker with enough addresses.
+	minFailReporters = 5
+)
+
+// newMissionControl starts from the saved histories, or from none when they
+// can't be loaded
+func newMissionControl(path string, halfLife time.Duration) *missionControl {
+	mc := &missionControl{
+		path:      path,
+		halfLife:  halfLife,
+		histories: map[edgeKey]channelHistory{},
+	}
+	err := mc.load()
+	if err != nil {
+		log.Println("error loading mission control, starting empty:", err)
+	}
+	return mc
+}
+
+// decay is the weight left, at now, of what was learned at t
+func (mc *missionControl) decay(t time.Time, now time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return math.Exp2(-float64(now.Sub(t)) / float64(mc.halfLife))
+}
+
+// probability is the estimated probability of forwarding msat through the
+// channel direction
+func (mc *missionControl) probability(key edgeKey, msat int64, now time.Time) float64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.probabilityLocked(key, msat, now)
+}
+
+func (mc *missionControl) probabilityLocked(
+	key edgeKey, msat int64, now time.Time,
+) float64 {
+	h, ok := mc.histories[key]
+	if !ok {
+		return aprioriProbability
+	}
+	p := aprioriProbability
+	if h.SuccessMsat > 0 && msat <= h.SuccessMsat {
+		p += (successProbability - aprioriProbability) * mc.decay(h.SuccessAt, now)
+	}
+	if h.FailMsat == 0 || msat >= h.FailMsat {
+		p *= 1 - mc.decay(h.FailAt, now)
+	}
+	return p
+}
+
+func (mc *missionControl) report(
+	reporter string, outcome PaymentOutcome, now time.Time,
+) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	key := edgeKey{outcome.ShortChannelId, outcome.Direction}
+	h := mc.histories[key]
+	switch outcome.Result {
+	case outcomeSuccess:
+		// an old success no longer vouches for its amount
+		if mc.decay(h.SuccessAt, now) < 0.5 {
+			h.SuccessMsat = 0
+		}
+		h.SuccessAt = now
+		h.SuccessMsat = max(h.SuccessMsat, outcome.AmountMsat)
+		if h.FailMsat == 0 {
+			h.FailAt = time.Time{}
+			h.FailReporters = nil
+		} else if outcome.AmountMsat >= h.FailMsat {
+			h.FailMsat = outcome.AmountMsat + 1
+		}
+	case outcomeTemporaryChannelFailure:
+		h.FailReporters = mc.failReporters(h, reporter, now)
+		h.FailAt = now
+		h.FailMsat = outcome.AmountMsat
+		h.SuccessMsat = max(0, min(h.SuccessMsat, outcome.AmountMsat-1))
+	case outcomeChannelDisabled, outcomeUnknownNextPeer, outcomePermanentChannelFailure:
+		h.FailReporters = mc.failReporters(h, reporter, now)
+		h.FailAt = now
+		h.FailMsat = 0
+		h.SuccessMsat = 0
+	default:
+		return stackerr.Wrap(fmt.Errorf("%w: %s", errUnknownOutcome, outcome.Result))
+	}
+	mc.histories[key] = h
+	mc.nReports++
+	mc.dirty = true
+	return nil
+}
+
+// failReporters adds the reporter of a new failure to those of the previous
+// failures, forgotten like an old success once half faded
+func (mc *missionControl) failReporters(
+	h channelHistory, reporter string, now time.Time,
+) []string {
+	if mc.decay(h.FailAt, now) < 0.5 {
+		return []string{reporter}
+	}
+	if len(h.FailReporters) >= minFailReporters ||
+		slices.Contains(h.FailReporters, reporter) {
+		return h.FailReporters
+	}
+	return append(slices.Clip(h.FailReporters), reporter)
+}
+
+// unreliableChans are the channels with a direction under minProbability
+// for msat, according to enough distinct reporters
+func (mc *missionControl) unreliableChans(
+	msat int64, minProbability float64, now time.Time,
+) []int64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var r []int64
+	for key, h := range mc.histories {
+		if len(h.FailReporters) < minFailReporters {
+			continue
+		}
+		if mc.probabilityLocked(key, msat, now) < minProbability {
+			r = append(r, key.ShortChannelId)
+		}
+	}
+	return r
+}
+
+// routeProbability is the estimated probability of the route delivering
+// msat to toPubkey
+func (mc *missionControl) routeProbability(
+	route PaymentRoute, toPubkey string, msat int64, now time.Time,
+) float64 {
+	p := 1.0
+	amounts := hopAmountsMsat(route, msat)
+	for i, hop := range route {
+		next := toPubkey
+		if i+1 < len(route) {
+			next = route[i+1].NodeId
+		}
+		key := edgeKey{hop.ShortChannelId, channelDirection(hop.NodeId, next)}
+		p *= mc.probability(key, amounts[i], now)
+	}
+	return p
+}
+
+type missionControlEntry struct {
+	ShortChannelId int64 `json:"scid"`
+	Direction      int   `json:"direction"`
+	channelHistory
+}
+
+// save writes the histories not yet faded out to the file, when reports
+// were received since the last save
+func (mc *missionControl) save(now time.Time) error {
+	const minWeight = 0.01
+	mc.mu.Lock()
+	if mc.path == "" || !mc.dirty {
+		mc.mu.Unlock()
+		return nil
+	}
+	mc.dirty = false
+	entries := make([]missionControlEntry, 0, len(mc.histories))
+	for key, h := range mc.histories {
+		if mc.decay(h.FailAt, now) < minWeight && mc.decay(h.SuccessAt, now) < minWeight {
+			delete(mc.histories, key)
+			continue
+		}
+		entries = append(entries, missionControlEntry{
+			key.ShortChannelId, key.Direction, h,
+		})
+	}
+	mc.mu.Unlock()
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	// the reports are saved with the next ones on failure
+	defer func() {
+		if err != nil {
+			mc.mu.Lock()
+			mc.dirty = true
+			mc.mu.Unlock()
+		}
+	}()
+	mc.saveMu.Lock()
+	defer mc.saveMu.Unlock()
+	// written aside then renamed, not to leave a truncated file
+	tmpPath := mc.path + ".tmp"
+	err = os.WriteFile(tmpPath, b, 0o600)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	err = os.Rename(tmpPath, mc.path)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (mc *missionControl) load() error {
+	if mc.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(mc.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	var entries []missionControlEntry
+	err = json.Unmarshal(b, &entries)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, v := range entries {
+		mc.histories[edgeKey{v.ShortChannelId, v.Direction}] = v.channelHistory
+	}
+	return nil
+}
+
+func (mc *missionControl) stats() map[string]int64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return map[string]int64{
+		"missionControlChannels": int64(len(mc.histories)),
+		"missionControlReports":  mc.nReports,
+	}
+}
+
+// missionRouter excludes the channels mission control deems unreliable from
+// the routes of the next RouteFinder, and ranks the routes found by their
+// fee penalized by their failure probability
+type missionRouter struct {
+	next           RouteFinder
+	mc             *missionControl
+	minProbability float64
+	stop           context.CancelFunc
+	stopped        chan struct{}
+}
+
+// NewMissionRouter persists mission control to path, if any, every
+// saveInterval and on Close
+func NewMissionRouter(
+	next RouteFinder, path string, halfLife time.Duration,
+) *missionRouter {
+	const (
+		minProbability = 0.1
+		saveInterval   = time.Minute
+	)
+	ctx, stop := context.WithCancel(context.Background())
+	mr := &missionRouter{
+		next:           next,
+		mc:             newMissionControl(path, halfLife),
+		minProbability: minProbability,
+		stop:           stop,
+		stopped:        make(chan struct{}),
+	}
+	go mr.saveLoop(ctx, saveInterval)
+	return mr
+}
+
+func (mr *missionRouter) saveLoop(ctx context.Context, interval time.Duration) {
+	defer close(mr.stopped)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		err := mr.mc.save(time.Now())
+		if err != nil {
+			log.Println("error saving mission control:", err)
+		}
+	}
+}
+
+// Close stops the periodic saves and saves the last reports
+func (mr *missionRouter) Close() error {
+	mr.stop()
+	<-mr.stopped
+	err := mr.mc.save(time.Now())
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (mr *missionRouter) FindRoutes(
+	ctx context.Context,
+	fromPubkeys []string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) ([]PaymentRoute, error) {
+	now := time.Now()
+	// exclusions apply to both channel directions, so a channel unreliable
+	// in a single direction is excluded altogether
+	unreliable := mr.mc.unreliableChans(msat, mr.minProbability, now)
+	if len(unreliable) > 0 {
+		chans := make([]int64, 0, len(excl.Chans)+len(unreliable))
+		chans = append(append(chans, excl.Chans...), unreliable...)
+		excl = RouteExclusions{Nodes: excl.Nodes, Chans: chans}
+	}
+
+	routes, err := mr.next.FindRoutes(ctx, fromPubkeys, toPubkey, msat, excl, limits)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	mr.sortRoutes(routes, toPubkey, msat, now)
+	return routes, nil
+}
+
+// sortRoutes sorts the routes by fee plus the cost of the expected failed
+// attempts before a success
+func (mr *missionRouter) sortRoutes(
+	routes []PaymentRoute, toPubkey string, msat int64, now time.Time,
+) {
+	const (
+		attemptCostMsat = 100
+		attemptCostPpm  = 1000
+	)
+	type scoredRoute struct {
+		route PaymentRoute
+		cost  float64
+	}
+	attemptCost := float64(attemptCostMsat + msat*attemptCostPpm/1_000_000)
+	scored := make([]scoredRoute, 0, len(routes))
+	for _, route := range routes {
+		p := mr.mc.routeProbability(route, toPubkey, msat, now)
+		cost := float64(routeFeeMsat(route, msat)) + (1/p-1)*attemptCost
+		scored = append(scored, scoredRoute{route, cost})
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].cost < scored[j].cost
+	})
+	for i, v := range scored {
+		routes[i] = v.route
+	}
+}
+
+func (mr *missionRouter) ReportOutcomes(reporter string, outcomes []PaymentOutcome) error {
+	for _, v := range outcomes {
+		switch v.Result {
+		case outcomeSuccess, outcomeTemporaryChannelFailure,
+			outcomeChannelDisabled, outcomeUnknownNextPeer,
+			outcomePermanentChannelFailure, outcomeFeeInsufficient,
+			outcomeIncorrectCltvExpiry, outcomeAmountBelowMinimum:
+		default:
+			return stackerr.Wrap(fmt.Errorf("%w: %s", errUnknownOutcome, v.Result))
+		}
+	}
+
+	now := time.Now()
+	for _, v := range outcomes {
+		switch v.Result {
+		case outcomeFeeInsufficient, outcomeIncorrectCltvExpiry, outcomeAmountBelowMinimum:
+			// the channel policy changed, the channel itself is fine
+			if pi, ok := mr.next.(policyInvalidator); ok {
+				pi.invalidatePolicy(v.ShortChannelId)
+			}
+			continue
+		}
+		err := mr.mc.report(reporter, v, now)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	return nil
+}
+
+func (mr *missionRouter) Stats() map[string]int64 {
+	stats := mr.mc.stats()
+	if sr, ok := mr.next.(StatsReporter); ok {
+		for k, v := range sr.Stats() {
+			stats[k] = v
+		}
+	}
+	return stats
+}
+
+func (mr *missionRouter) invalidatePolicy(scid int64) {
+	if pi, ok := mr.next.(policyInvalidator); ok {
+		pi.invalidatePolicy(scid)
+	}
+}
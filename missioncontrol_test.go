@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_missionControl(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mc.json")
+	mc := newMissionControl(path, time.Hour)
+	// without monotonic reading, to compare with the loaded times
+	now := time.Now().UTC().Round(0)
+	key := edgeKey{1, 0}
+
+	err := mc.report("w1", PaymentOutcome{1, 0, 500_000, outcomeTemporaryChannelFailure}, now)
+	tu.Must(t, err)
+
+	// smaller amounts are unaffected by the liquidity failure
+	if p := mc.probability(key, 100_000, now); p != aprioriProbability {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", aprioriProbability, p)
+	}
+	if p := mc.probability(key, 500_000, now); p != 0 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 0, p)
+	}
+	// half of the failure is forgotten after the half life
+	if p := mc.probability(key, 500_000, now.Add(time.Hour)); p != aprioriProbability/2 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", aprioriProbability/2, p)
+	}
+
+	err = mc.report("w1", PaymentOutcome{1, 0, 200_000, outcomeSuccess}, now)
+	tu.Must(t, err)
+	if p := mc.probability(key, 200_000, now); p != successProbability {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", successProbability, p)
+	}
+
+	err = mc.report("w1", PaymentOutcome{1, 0, 0, "unknown"}, now)
+	if err == nil {
+		t.Fatalf("expecting error for unknown outcome")
+	}
+
+	tu.Must(t, mc.save(now))
+	loaded := newMissionControl(path, time.Hour)
+	if !reflect.DeepEqual(mc.histories, loaded.histories) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", mc.histories, loaded.histories)
+	}
+
+	// an unreadable file is not loaded, nor is a missing path
+	tu.Must(t, os.WriteFile(path, []byte("{"), 0o600))
+	if r := newMissionControl(path, time.Hour); len(r.histories) != 0 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 0, len(r.histories))
+	}
+	mc = newMissionControl("", time.Hour)
+	tu.Must(t, mc.report("w1", PaymentOutcome{1, 0, 0, outcomeChannelDisabled}, now))
+	tu.Must(t, mc.save(now))
+}
+
+func Test_missionRouterFindRoutes(t *testing.T) {
+	next := listRouteFinder{
+		{{NodeId: "a", ShortChannelId: 1}},
+		{{NodeId: "a", ShortChannelId: 2, FeeBaseMsat: 10}},
+	}
+	path := filepath.Join(t.TempDir(), "mc.json")
+	mr := NewMissionRouter(next, path, time.Hour)
+	defer mr.Close()
+	ctx := context.Background()
+
+	r, err := mr.FindRoutes(ctx, nil, "b", 1000, RouteExclusions{}, RouteLimits{})
+	tu.Must(t, err)
+	if expected := []PaymentRoute(next[:1]); !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	disabled := []PaymentOutcome{
+		{1, channelDirection("a", "b"), 1000, outcomeChannelDisabled},
+	}
+	// fewer than minFailReporters reporters only lower the rank of the
+	// channel, even reporting again
+	for range 2 {
+		tu.Must(t, mr.ReportOutcomes("w1", disabled))
+	}
+	r, err = mr.FindRoutes(ctx, nil, "b", 1000, RouteExclusions{}, RouteLimits{})
+	tu.Must(t, err)
+	if expected := []PaymentRoute(next[:1]); !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	for i := 2; i < minFailReporters; i++ {
+		tu.Must(t, mr.ReportOutcomes(fmt.Sprintf("w%d", i), disabled))
+	}
+	r, err = mr.FindRoutes(ctx, nil, "b", 1000, RouteExclusions{}, RouteLimits{})
+	tu.Must(t, err)
+	if expected := []PaymentRoute(next[:1]); !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	tu.Must(t, mr.ReportOutcomes(fmt.Sprintf("w%d", minFailReporters), disabled))
+	r, err = mr.FindRoutes(ctx, nil, "b", 1000, RouteExclusions{}, RouteLimits{})
+	tu.Must(t, err)
+	if expected := []PaymentRoute(next[1:]); !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	// the reports are saved on close, not on each report
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", os.ErrNotExist, err)
+	}
+	tu.Must(t, mr.Close())
+	if r := newMissionControl(path, time.Hour); len(r.histories) != 1 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 1, len(r.histories))
+	}
+}
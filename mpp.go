@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"master.private/bstd.git/stackerr"
+)
+
+var errNoMppSplit = errors.New("no split of the amount over disjoint routes")
+
+// paymentPart is a shard of a multi-part payment
+type paymentPart struct {
+	Route      PaymentRoute
+	AmountMsat int64
+}
+
+// splitPayment splits msat over at most maxParts disjoint routes, each part
+// carrying at least minShardMsat and no more than its channels htlc maximum.
+// Parts are found one at a time, the channels of the previous parts being
+// excluded from the next searches.
+func splitPayment(
+	ctx context.Context,
+	rf RouteFinder,
+	fromPubkeys []string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+	minShardMsat int64,
+	maxParts int64,
+) ([]paymentPart, error) {
+	// the fee budget applies to the whole payment, checked once split
+	maxFeeMsat := limits.maxFeeMsat(msat)
+	partLimits := limits
+	partLimits.MaxFeeMsat = 0
+
+	var (
+		parts     []paymentPart
+		remaining = msat
+		feeMsat   int64
+	)
+	// discarded routes still have their channels excluded, the number of
+	// searches is bounded anyway
+	for attempt := int64(0); remaining > 0 && int64(len(parts)) < maxParts &&
+		attempt < 2*maxParts; attempt++ {
+		searchMsat := min(remaining, minShardMsat)
+		routes, err := rf.FindRoutes(
+			ctx, fromPubkeys, toPubkey, searchMsat, excl, partLimits,
+		)
+		if err != nil {
+			if len(parts) == 0 {
+				return nil, stackerr.Wrap(err)
+			}
+			log.Println("no route for the next part:", err)
+			break
+		}
+		if len(routes) == 0 {
+			break
+		}
+		route := routes[0]
+		for _, hop := range route {
+			excl = excl.withChan(hop.ShortChannelId)
+		}
+
+		amount := maxDeliverableMsat(route, remaining)
+		// the amount left for the next parts must not be under a shard
+		if left := remaining - amount; left > 0 && left < minShardMsat {
+			amount = remaining - minShardMsat
+		}
+		if amount < searchMsat {
+			log.Printf("discarding part route, carrying only %d msat\n", amount)
+			continue
+		}
+		if _, err := validateRoute(route, amount); err != nil {
+			log.Println("discarding part route:", err)
+			continue
+		}
+
+		parts = append(parts, paymentPart{route, amount})
+		remaining -= amount
+		feeMsat += routeFeeMsat(route, amount)
+	}
+
+	if remaining > 0 {
+		return nil, stackerr.Wrap(fmt.Errorf(
+			"%w: %d msat left over %d parts", errNoMppSplit, remaining, len(parts),
+		))
+	}
+	if maxFeeMsat > 0 && feeMsat > maxFeeMsat {
+		return nil, stackerr.Wrap(fmt.Errorf(
+			"%w: parts fee %d msat", errNoRouteWithinBudget, feeMsat,
+		))
+	}
+	return parts, nil
+}
+
+// maxDeliverableMsat is the highest amount, up to upToMsat, the route
+// delivers without any hop forwarding more than its htlc maximum
+func maxDeliverableMsat(route PaymentRoute, upToMsat int64) int64 {
+	fits := func(msat int64) bool {
+		for i, v := range hopAmountsMsat(route, msat) {
+			if htlcMax := route[i].HtlcMaximumMsat; htlcMax > 0 && v > htlcMax {
+				return false
+			}
+		}
+		return true
+	}
+	if fits(upToMsat) {
+		return upToMsat
+	}
+	// the forwarded amounts grow with the delivered amount
+	lo, hi := int64(0), upToMsat
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
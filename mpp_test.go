@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+// listRouteFinder returns the first of its routes not excluded
+type listRouteFinder []PaymentRoute
+
+func (l listRouteFinder) FindRoutes(
+	_ context.Context,
+	_ []string,
+	_ string,
+	_ int64,
+	excl RouteExclusions,
+	_ RouteLimits,
+) ([]PaymentRoute, error) {
+next:
+	for _, route := range l {
+		for _, hop := range route {
+			for _, scid := range excl.Chans {
+				if hop.ShortChannelId == scid {
+					continue next
+				}
+			}
+		}
+		return []PaymentRoute{route}, nil
+	}
+	return nil, fmt.Errorf("no route")
+}
+
+func Test_splitPayment(t *testing.T) {
+	rf := listRouteFinder{
+		{{NodeId: "a", ShortChannelId: 1, HtlcMaximumMsat: 600_000}},
+		{{NodeId: "a", ShortChannelId: 2, HtlcMaximumMsat: 300_000}},
+		{{NodeId: "a", ShortChannelId: 3}},
+	}
+	ctx := context.Background()
+
+	parts, err := splitPayment(
+		ctx, rf, nil, "b", 1_000_000, RouteExclusions{}, RouteLimits{}, 100_000, 8,
+	)
+	tu.Must(t, err)
+
+	expected := []paymentPart{
+		{rf[0], 600_000},
+		{rf[1], 300_000},
+		{rf[2], 100_000},
+	}
+	if !reflect.DeepEqual(expected, parts) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, parts)
+	}
+
+	// the part left for the last route would be under the minimum shard
+	parts, err = splitPayment(
+		ctx, rf, nil, "b", 1_000_000, RouteExclusions{}, RouteLimits{}, 200_000, 8,
+	)
+	tu.Must(t, err)
+
+	expected = []paymentPart{
+		{rf[0], 600_000},
+		{rf[1], 200_000},
+		{rf[2], 200_000},
+	}
+	if !reflect.DeepEqual(expected, parts) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, parts)
+	}
+
+	_, err = splitPayment(
+		ctx, rf, nil, "b", 1_000_000, RouteExclusions{}, RouteLimits{}, 100_000, 2,
+	)
+	if !errors.Is(err, errNoMppSplit) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", errNoMppSplit, err)
+	}
+}
+
+func Test_maxDeliverableMsat(t *testing.T) {
+	route := PaymentRoute{
+		{FeeBaseMsat: 1000, HtlcMaximumMsat: 500_000},
+		{FeeProportionalMillionths: 10_000, HtlcMaximumMsat: 1_000_000},
+	}
+	// the first hop forwards the amount plus 1%
+	amount := maxDeliverableMsat(route, 1_000_000)
+	if amount != 495_050 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 495_050, amount)
+	}
+
+	amount = maxDeliverableMsat(route, 100_000)
+	if amount != 100_000 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 100_000, amount)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// nodeStats summarizes the channels a node forwards through
+type nodeStats struct {
+	NodeId      string
+	Alias       string
+	NumPeers    int64
+	NumChannels int64
+	// CapacityMsat is the total capacity of the node channels
+	CapacityMsat int64
+	// MedianFeePpm is the median fee of the node channels to forward
+	// nodeStatsFeeRefMsat, as parts per million
+	MedianFeePpm int64
+	// MedianAgeBlocks is the median age of the node channels, relative to
+	// the most recent channel of the graph
+	MedianAgeBlocks int64
+	// Uptime is the share of the node channels enabled and updated lately,
+	// lowered by the channels switching between enabled and disabled since
+	// the process started
+	Uptime float64
+}
+
+// nodeStatsLister lists the stats of the nodes of the graph
+type nodeStatsLister interface {
+	nodeStats(ctx context.Context) ([]nodeStats, error)
+}
+
+const (
+	nodeStatsFeeRefMsat = 100_000_000
+	// channels not updated within this time are considered down
+	nodeStatsStaleSeconds = 14 * 24 * 60 * 60
+)
+
+// nodeStats computes the stats of each node from its outgoing edges
+func (g *channelGraph) nodeStats() []nodeStats {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var lastHeight, lastUpdate int64
+	out := map[string][]*graphEdge{}
+	for _, e := range g.edges {
+		out[e.Source] = append(out[e.Source], e)
+		lastHeight = max(lastHeight, e.ShortChannelId>>40)
+		lastUpdate = max(lastUpdate, e.LastUpdate)
+	}
+
+	r := make([]nodeStats, 0, len(out))
+	for nodeId, edges := range out {
+		peers := map[string]struct{}{}
+		fees := make([]int64, 0, len(edges))
+		ages := make([]int64, 0, len(edges))
+		var nUp, nToggles int64
+		s := nodeStats{
+			NodeId:      nodeId,
+			Alias:       g.nodes[nodeId].Alias,
+			NumChannels: int64(len(edges)),
+		}
+		for _, e := range edges {
+			peers[e.Destination] = struct{}{}
+			s.CapacityMsat += e.CapacityMsat
+			fees = append(fees, hopFeeMsat(e.toHop(), nodeStatsFeeRefMsat)*
+				1_000_000/nodeStatsFeeRefMsat)
+			ages = append(ages, lastHeight-e.ShortChannelId>>40)
+			if !e.Disabled && lastUpdate-e.LastUpdate <= nodeStatsStaleSeconds {
+				nUp++
+			}
+			nToggles += e.DisableToggles
+		}
+		s.NumPeers = int64(len(peers))
+		s.MedianFeePpm = median(fees)
+		s.MedianAgeBlocks = median(ages)
+		s.Uptime = float64(nUp) / float64(len(edges)) /
+			(1 + float64(nToggles)/float64(len(edges)))
+		r = append(r, s)
+	}
+	return r
+}
+
+func median(v []int64) int64 {
+	if len(v) == 0 {
+		return 0
+	}
+	slices.Sort(v)
+	return v[len(v)/2]
+}
+
+// nodeRecommendation is a node suggested as channel peer, Score being in
+// [0, 1]
+type nodeRecommendation struct {
+	NodeId          string  `json:"nodeId"`
+	Alias           string  `json:"alias"`
+	Score           float64 `json:"score"`
+	NumPeers        int64   `json:"numPeers"`
+	NumChannels     int64   `json:"numChannels"`
+	CapacityMsat    int64   `json:"capacityMsat"`
+	MedianFeePpm    int64   `json:"medianFeePpm"`
+	MedianAgeBlocks int64   `json:"medianAgeBlocks"`
+	Uptime          float64 `json:"uptime"`
+}
+
+// nodeRecommender ranks the nodes of the graph as channel peers, by their
+// centrality, capacity, fees, channel age and uptime, never suggesting the
+// blocked nodes
+type nodeRecommender struct {
+	lister      nodeStatsLister
+	blocked     map[string]bool
+	minChannels int64
+}
+
+func NewNodeRecommender(lister nodeStatsLister, blocked []string) *nodeRecommender {
+	const minChannels = 5
+	nr := &nodeRecommender{
+		lister:      lister,
+		blocked:     make(map[string]bool, len(blocked)),
+		minChannels: minChannels,
+	}
+	for _, v := range blocked {
+		nr.blocked[strings.ToLower(v)] = true
+	}
+	return nr
+}
+
+// recommend returns up to maxNodes nodes, best first
+func (nr *nodeRecommender) recommend(
+	ctx context.Context, maxNodes int64,
+) ([]nodeRecommendation, error) {
+	stats, err := nr.lister.nodeStats(ctx)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	candidates := make([]nodeStats, 0, len(stats))
+	for _, s := range stats {
+		if nr.blocked[strings.ToLower(s.NodeId)] || s.NumChannels < nr.minChannels {
+			continue
+		}
+		candidates = append(candidates, s)
+	}
+	r := rankNodes(candidates)
+	if int64(len(r)) > maxNodes {
+		r = r[:maxNodes]
+	}
+	return r, nil
+}
+
+// rankNodes scores each node by the weighted percentiles of its stats among
+// the nodes, so that no stat dominates by its scale
+func rankNodes(stats []nodeStats) []nodeRecommendation {
+	type signal struct {
+		weight       float64
+		higherBetter bool
+		value        func(s nodeStats) float64
+	}
+	signals := []signal{
+		{0.3, true, func(s nodeStats) float64 { return float64(s.NumPeers) }},
+		{0.25, true, func(s nodeStats) float64 { return float64(s.CapacityMsat) }},
+		{0.15, false, func(s nodeStats) float64 { return float64(s.MedianFeePpm) }},
+		{0.15, true, func(s nodeStats) float64 { return float64(s.MedianAgeBlocks) }},
+		{0.15, true, func(s nodeStats) float64 { return s.Uptime }},
+	}
+
+	scores := make([]float64, len(stats))
+	for _, sig := range signals {
+		values := make([]float64, len(stats))
+		for i, s := range stats {
+			values[i] = sig.value(s)
+		}
+		for i, p := range percentiles(values, sig.higherBetter) {
+			scores[i] += sig.weight * p
+		}
+	}
+
+	r := make([]nodeRecommendation, len(stats))
+	for i, s := range stats {
+		r[i] = nodeRecommendation{
+			NodeId:          s.NodeId,
+			Alias:           s.Alias,
+			Score:           math.Round(scores[i]*1000) / 1000,
+			NumPeers:        s.NumPeers,
+			NumChannels:     s.NumChannels,
+			CapacityMsat:    s.CapacityMsat,
+			MedianFeePpm:    s.MedianFeePpm,
+			MedianAgeBlocks: s.MedianAgeBlocks,
+			Uptime:          s.Uptime,
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool {
+		if r[i].Score != r[j].Score {
+			return r[i].Score > r[j].Score
+		}
+		return r[i].NodeId < r[j].NodeId
+	})
+	return r
+}
+
+// percentiles maps each value to the share, in [0, 1], of the other values
+// it is better than, equal values sharing the same percentile
+func percentiles(values []float64, higherBetter bool) []float64 {
+	r := make([]float64, len(values))
+	if len(values) < 2 {
+		for i := range r {
+			r[i] = 1
+		}
+		return r
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	for i, v := range values {
+		nBelow, _ := slices.BinarySearch(sorted, v)
+		nBetter := nBelow
+		if !higherBetter {
+			nAbove := len(sorted) - sort.Search(len(sorted), func(j int) bool {
+				return sorted[j] > v
+			})
+			nBetter = nAbove
+		}
+		r[i] = float64(nBetter) / float64(len(values)-1)
+	}
+	return r
+}
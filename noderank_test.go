@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_channelGraphNodeStats(t *testing.T) {
+	const (
+		a = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		b = "02bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+		c = "02cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+	)
+	newChan := func(source, destination, scid string, feeBase, lastUpdate int64) clnChan {
+		return clnChan{
+			Source:          source,
+			Destination:     destination,
+			ShortChannelId:  scid,
+			BaseFeeMsat:     feeBase,
+			FeePerMillionth: 100,
+			Delay:           40,
+			HtlcMinMsat:     1,
+			HtlcMaxMsat:     1000000000,
+			AmountMsat:      1000000000,
+			Active:          true,
+			LastUpdate:      lastUpdate,
+		}
+	}
+	const fifteenDays = 15 * 24 * 60 * 60
+	g := newChannelGraph()
+	g.applyChannels([]clnChan{
+		newChan(a, b, "877000x1x0", 1000, 1700000000),
+		newChan(b, a, "877000x1x0", 1000, 1700000000-fifteenDays),
+		newChan(a, c, "877236x2x0", 2000, 1700000000),
+	})
+	// a disables its channel with b
+	disabled := newChan(a, b, "877000x1x0", 1000, 1700000001)
+	disabled.Active = false
+	g.applyChannels([]clnChan{
+		disabled,
+		newChan(b, a, "877000x1x0", 1000, 1700000000-fifteenDays),
+		newChan(a, c, "877236x2x0", 2000, 1700000000),
+	})
+	g.applyNodes([]clnNode{{a, "A", 1700000000}})
+
+	r := g.nodeStats()
+	sort.Slice(r, func(i, j int) bool { return r[i].NodeId < r[j].NodeId })
+	expected := []nodeStats{
+		{
+			NodeId:          a,
+			Alias:           "A",
+			NumPeers:        2,
+			NumChannels:     2,
+			CapacityMsat:    2000000000,
+			MedianFeePpm:    120,
+			MedianAgeBlocks: 236,
+			// one channel up of two, with one toggle
+			Uptime: 0.5 / 1.5,
+		},
+		{
+			NodeId:          b,
+			NumPeers:        1,
+			NumChannels:     1,
+			CapacityMsat:    1000000000,
+			MedianFeePpm:    110,
+			MedianAgeBlocks: 236,
+		},
+	}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+}
+
+func Test_percentiles(t *testing.T) {
+	values := []float64{3, 1, 2, 2}
+
+	r := percentiles(values, true)
+	expected := []float64{1, 0, 1.0 / 3, 1.0 / 3}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+
+	r = percentiles(values, false)
+	expected = []float64{0, 1, 1.0 / 3, 1.0 / 3}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+}
+
+type staticNodeStats []nodeStats
+
+func (s staticNodeStats) nodeStats(_ context.Context) ([]nodeStats, error) {
+	return s, nil
+}
+
+func Test_nodeRecommenderRecommend(t *testing.T) {
+	lister := staticNodeStats{
+		// best on all signals, but blocked
+		{NodeId: "a", NumPeers: 50, NumChannels: 60, CapacityMsat: 9e12, MedianAgeBlocks: 9000, Uptime: 1},
+		{NodeId: "b", NumPeers: 20, NumChannels: 20, CapacityMsat: 1e12, MedianFeePpm: 100, MedianAgeBlocks: 1000, Uptime: 1},
+		{NodeId: "c", NumPeers: 10, NumChannels: 10, CapacityMsat: 2e12, MedianFeePpm: 500, MedianAgeBlocks: 500, Uptime: 0.5},
+		// too few channels
+		{NodeId: "d", NumPeers: 2, NumChannels: 2, CapacityMsat: 1e9, Uptime: 1},
+	}
+	nr := NewNodeRecommender(lister, []string{"A"})
+
+	r, err := nr.recommend(context.Background(), 10)
+	tu.Must(t, err)
+	nodeIds := make([]string, len(r))
+	for i, v := range r {
+		nodeIds[i] = v.NodeId
+	}
+	expected := []string{"b", "c"}
+	if !reflect.DeepEqual(expected, nodeIds) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, nodeIds)
+	}
+	// c only has the better capacity
+	if r[0].Score != 0.75 || r[1].Score != 0.25 {
+		t.Fatalf("unexpected scores: %+v", r)
+	}
+}
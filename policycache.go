@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// policyCache keeps the listchannels result of each channel, by short
+// channel id, shared across route requests. Entries expire after the ttl, or
+// earlier when a newer channel update is observed.
+type policyCache struct {
+	mu        sync.Mutex
+	entries   map[int64]policyCacheEntry
+	ttl       time.Duration
+	lastSweep time.Time
+	hits      int64
+	misses    int64
+}
+
+type policyCacheEntry struct {
+	chans      []clnChan
+	lastUpdate int64
+	fetchTime  time.Time
+}
+
+func newPolicyCache(ttl time.Duration) *policyCache {
+	return &policyCache{
+		entries:   map[int64]policyCacheEntry{},
+		ttl:       ttl,
+		lastSweep: time.Now(),
+	}
+}
+
+func (p *policyCache) get(scid int64) ([]clnChan, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[scid]
+	if !ok || time.Since(entry.fetchTime) > p.ttl {
+		p.misses++
+		return nil, false
+	}
+	p.hits++
+	return entry.chans, true
+}
+
+func (p *policyCache) put(scid int64, chans []clnChan) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.lastSweep) > p.ttl {
+		p.sweep(now)
+	}
+	var lastUpdate int64
+	for _, c := range chans {
+		lastUpdate = max(lastUpdate, c.LastUpdate)
+	}
+	p.entries[scid] = policyCacheEntry{
+		chans:      chans,
+		lastUpdate: lastUpdate,
+		fetchTime:  now,
+	}
+}
+
+// observeUpdate drops the cached channel when lastUpdate is newer than the
+// updates it was cached with
+func (p *policyCache) observeUpdate(scid int64, lastUpdate int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[scid]
+	if ok && entry.lastUpdate < lastUpdate {
+		delete(p.entries, scid)
+	}
+}
+
+// scids returns the short channel ids of the unexpired entries
+func (p *policyCache) scids() []int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := make([]int64, 0, len(p.entries))
+	for scid, entry := range p.entries {
+		if time.Since(entry.fetchTime) <= p.ttl {
+			r = append(r, scid)
+		}
+	}
+	return r
+}
+
+func (p *policyCache) invalidate(scid int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.entries, scid)
+}
+
+func (p *policyCache) stats() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return map[string]int64{
+		"policyCacheHits":   p.hits,
+		"policyCacheMisses": p.misses,
+		"policyCacheSize":   int64(len(p.entries)),
+	}
+}
+
+func (p *policyCache) sweep(now time.Time) {
+	for scid, entry := range p.entries {
+		if now.Sub(entry.fetchTime) > p.ttl {
+			delete(p.entries, scid)
+		}
+	}
+	p.lastSweep = now
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_policyCache(t *testing.T) {
+	const scid int64 = 964531182376517632
+	chans := []clnChan{
+		{ShortChannelId: "877236x1111x0", LastUpdate: 1700000000},
+		{ShortChannelId: "877236x1111x0", LastUpdate: 1700000100},
+	}
+	p := newPolicyCache(time.Minute)
+
+	if _, ok := p.get(scid); ok {
+		t.Fatal("unexpected hit on empty cache")
+	}
+	p.put(scid, chans)
+	if _, ok := p.get(scid); !ok {
+		t.Fatal("unexpected miss")
+	}
+
+	p.observeUpdate(scid, 1700000100)
+	if _, ok := p.get(scid); !ok {
+		t.Fatal("unexpected miss after same update")
+	}
+	p.observeUpdate(scid, 1700000200)
+	if _, ok := p.get(scid); ok {
+		t.Fatal("unexpected hit after newer update")
+	}
+
+	stats := p.stats()
+	if stats["policyCacheHits"] != 2 || stats["policyCacheMisses"] != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// routeProber sends probes along routes starting at the lightning node,
+// returning what was learned of each channel
+type routeProber interface {
+	probe(
+		ctx context.Context, route PaymentRoute, toPubkey string, msat int64,
+	) ([]PaymentOutcome, error)
+}
+
+// probeReporter is the reporter of the probe outcomes, one among the
+// wallets reporting their payments
+const probeReporter = "probe"
+
+// maxDemandDestinations caps the destinations tracked during a probing
+// round, the destinations beyond it being ignored until the next round
+const maxDemandDestinations = 10_000
+
+// destinationDemand is how much a destination was requested during the
+// current probing round
+type destinationDemand struct {
+	nRequests int64
+	maxMsat   int64
+}
+
+// probingRouter tracks the most requested destinations and, each round,
+// probes routes to them for the largest amount requested. The outcomes are
+// reported to the next RouteFinder, so that it prefers the routes known to
+// carry the amount.
+type probingRouter struct {
+	next     RouteFinder
+	prober   routeProber
+	reporter OutcomeReporter
+	budget   int64
+	stop     context.CancelFunc
+	stopped  chan struct{}
+
+	mu      sync.Mutex
+	demand  map[string]destinationDemand
+	nProbes int64
+	nErrors int64
+}
+
+// NewProbingRouter probes in background, every interval, at most budget
+// routes
+func NewProbingRouter(
+	next RouteFinder, prober routeProber, interval time.Duration, budget int64,
+) *probingRouter {
+	reporter, ok := next.(OutcomeReporter)
+	if !ok {
+		panic("probing needs a route finder learning from payment outcomes")
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	pr := &probingRouter{
+		next:     next,
+		prober:   prober,
+		reporter: reporter,
+		budget:   budget,
+		stop:     stop,
+		stopped:  make(chan struct{}),
+		demand:   map[string]destinationDemand{},
+	}
+	go pr.probeLoop(ctx, interval)
+	return pr
+}
+
+// Close stops the probing, waiting for the current probe to be abandoned
+func (pr *probingRouter) Close() error {
+	pr.stop()
+	<-pr.stopped
+	return nil
+}
+
+func (pr *probingRouter) FindRoutes(
+	ctx context.Context,
+	fromPubkeys []string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) ([]PaymentRoute, error) {
+	pr.mu.Lock()
+	d, ok := pr.demand[toPubkey]
+	if ok || len(pr.demand) < maxDemandDestinations {
+		d.nRequests++
+		d.maxMsat = max(d.maxMsat, msat)
+		pr.demand[toPubkey] = d
+	}
+	pr.mu.Unlock()
+
+	routes, err := pr.next.FindRoutes(ctx, fromPubkeys, toPubkey, msat, excl, limits)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return routes, nil
+}
+
+func (pr *probingRouter) probeLoop(ctx context.Context, interval time.Duration) {
+	defer close(pr.stopped)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		roundCtx, cancel := context.WithTimeout(ctx, interval)
+		pr.probeRound(roundCtx)
+		cancel()
+	}
+}
+
+// probeRound spends the budget on the destinations most requested since the
+// previous round, one route at a time from the most requested
+func (pr *probingRouter) probeRound(ctx context.Context) {
+	type destination struct {
+		pubkey string
+		destinationDemand
+	}
+	pr.mu.Lock()
+	destinations := make([]destination, 0, len(pr.demand))
+	for k, v := range pr.demand {
+		destinations = append(destinations, destination{k, v})
+	}
+	pr.demand = map[string]destinationDemand{}
+	pr.mu.Unlock()
+	sort.Slice(destinations, func(i, j int) bool {
+		return destinations[i].nRequests > destinations[j].nRequests
+	})
+
+	budget := pr.budget
+	for _, dest := range destinations {
+		if budget <= 0 || ctx.Err() != nil {
+			return
+		}
+		routes, err := pr.next.FindRoutes(
+			ctx, nil, dest.pubkey, dest.maxMsat, RouteExclusions{}, RouteLimits{},
+		)
+		if err != nil {
+			log.Printf("no route to probe %s: %s\n", dest.pubkey, err)
+			continue
+		}
+		for _, route := range routes {
+			if budget <= 0 {
+				break
+			}
+			budget--
+			pr.probeRoute(ctx, route, dest.pubkey, dest.maxMsat)
+		}
+	}
+}
+
+func (pr *probingRouter) probeRoute(
+	ctx context.Context, route PaymentRoute, toPubkey string, msat int64,
+) {
+	outcomes, err := pr.prober.probe(ctx, route, toPubkey, msat)
+
+	pr.mu.Lock()
+	pr.nProbes++
+	if err != nil {
+		pr.nErrors++
+	}
+	pr.mu.Unlock()
+
+	if err != nil {
+		log.Printf("error probing %s: %s\n", toPubkey, err)
+		return
+	}
+	err = pr.reporter.ReportOutcomes(probeReporter, outcomes)
+	if err != nil {
+		log.Println("error reporting probe outcomes:", err)
+	}
+}
+
+func (pr *probingRouter) ReportOutcomes(reporter string, outcomes []PaymentOutcome) error {
+	err := pr.reporter.ReportOutcomes(reporter, outcomes)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (pr *probingRouter) Stats() map[string]int64 {
+	stats := map[string]int64{}
+	if sr, ok := pr.next.(StatsReporter); ok {
+		stats = sr.Stats()
+	}
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	stats["probes"] = pr.nProbes
+	stats["probeErrors"] = pr.nErrors
+	return stats
+}
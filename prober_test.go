@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+type fakeProber struct {
+	mu     sync.Mutex
+	probed []string
+}
+
+func (f *fakeProber) probe(
+	_ context.Context, route PaymentRoute, toPubkey string, msat int64,
+) ([]PaymentOutcome, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probed = append(f.probed, toPubkey)
+	return []PaymentOutcome{
+		{route[0].ShortChannelId, 0, msat, outcomeTemporaryChannelFailure},
+	}, nil
+}
+
+func Test_probingRouterProbeRound(t *testing.T) {
+	next := NewMissionRouter(
+		listRouteFinder{{{NodeId: "a", ShortChannelId: 1}}},
+		filepath.Join(t.TempDir(), "mc.json"), time.Hour,
+	)
+	defer next.Close()
+	prober := &fakeProber{}
+	pr := &probingRouter{
+		next:     next,
+		prober:   prober,
+		reporter: next,
+		budget:   1,
+		demand:   map[string]destinationDemand{},
+	}
+	ctx := context.Background()
+	for _, to := range []string{"b", "c", "c"} {
+		_, err := pr.FindRoutes(ctx, nil, to, 1000, RouteExclusions{}, RouteLimits{})
+		tu.Must(t, err)
+	}
+
+	// the budget only allows probing the most requested destination
+	pr.probeRound(ctx)
+	if expected := []string{"c"}; !reflect.DeepEqual(expected, prober.probed) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, prober.probed)
+	}
+	// the outcome was learned
+	if p := next.mc.probability(edgeKey{1, 0}, 1000, time.Now()); p > 0.01 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", "~0", p)
+	}
+}
+
+func Test_probingRouterDemandCap(t *testing.T) {
+	pr := &probingRouter{
+		next:   listRouteFinder{{{NodeId: "a", ShortChannelId: 1}}},
+		demand: map[string]destinationDemand{},
+	}
+	ctx := context.Background()
+	for i := range maxDemandDestinations + 1 {
+		_, err := pr.FindRoutes(ctx, nil, strconv.Itoa(i), 1000, RouteExclusions{}, RouteLimits{})
+		tu.Must(t, err)
+	}
+	// the tracked destinations are still counted, the new ones ignored
+	_, err := pr.FindRoutes(ctx, nil, "0", 1000, RouteExclusions{}, RouteLimits{})
+	tu.Must(t, err)
+	if n := len(pr.demand); n != maxDemandDestinations {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", maxDemandDestinations, n)
+	}
+	if n := pr.demand["0"].nRequests; n != 2 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 2, n)
+	}
+}
+
+func Test_probingRouterClose(t *testing.T) {
+	next := NewMissionRouter(
+		listRouteFinder{{{NodeId: "a", ShortChannelId: 1}}}, "", time.Hour,
+	)
+	defer next.Close()
+	prober := &fakeProber{}
+	pr := NewProbingRouter(next, prober, time.Millisecond, 1)
+	ctx := context.Background()
+	_, err := pr.FindRoutes(ctx, nil, "b", 1000, RouteExclusions{}, RouteLimits{})
+	tu.Must(t, err)
+	tu.Must(t, pr.Close())
+
+	// no round runs after close, even with demand
+	prober.mu.Lock()
+	nProbed := len(prober.probed)
+	prober.mu.Unlock()
+	_, err = pr.FindRoutes(ctx, nil, "b", 1000, RouteExclusions{}, RouteLimits{})
+	tu.Must(t, err)
+	time.Sleep(20 * time.Millisecond)
+	prober.mu.Lock()
+	defer prober.mu.Unlock()
+	if len(prober.probed) != nProbed {
+		t.Fatalf("probing after close: %d probes, then %d", nProbed, len(prober.probed))
+	}
+}
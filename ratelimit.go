@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per client, refilled with one token every
+// interval up to burst tokens
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]rateBucket
+	interval  time.Duration
+	burst     float64
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(interval time.Duration, burst int64) *rateLimiter {
+	return &rateLimiter{
+		buckets:   map[string]rateBucket{},
+		interval:  interval,
+		burst:     float64(burst),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token of the client, reporting false when none is left
+func (rl *rateLimiter) allow(client string, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	fullAfter := rl.interval * time.Duration(rl.burst)
+	if now.Sub(rl.lastSweep) > fullAfter {
+		rl.sweep(now, fullAfter)
+	}
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = rateBucket{tokens: rl.burst}
+	} else {
+		b.tokens = min(rl.burst, b.tokens+float64(now.Sub(b.last))/float64(rl.interval))
+	}
+	b.last = now
+	if b.tokens < 1 {
+		rl.buckets[client] = b
+		return false
+	}
+	b.tokens--
+	rl.buckets[client] = b
+	return true
+}
+
+// sweep drops the buckets refilled to the burst, the same as missing ones
+func (rl *rateLimiter) sweep(now time.Time, fullAfter time.Duration) {
+	for client, b := range rl.buckets {
+		if now.Sub(b.last) > fullAfter {
+			delete(rl.buckets, client)
+		}
+	}
+	rl.lastSweep = now
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// routeSearch finds the best route from fromPubkey to the destination
+// avoiding the exclusions
+type routeSearch func(
+	ctx context.Context, fromPubkey string, excl RouteExclusions,
+) (PaymentRoute, error)
+
+var errNoRouteWithinBudget = errors.New("no route within budget")
+
+// maxSources caps the sources of a request, the best route from each one
+// being searched concurrently
+const maxSources = 8
+
+var errTooManySources = fmt.Errorf("more than %d sources", maxSources)
+
+// findAlternativeRoutes finds up to maxRoutes distinct routes within limits.
+// The best route from each source is searched first, then alternatives are
+// found by excluding, one at a time, each channel of the routes already found.
+func findAlternativeRoutes(
+	ctx context.Context,
+	search routeSearch,
+	fromPubkeys []string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+	maxRoutes int64,
+) ([]PaymentRoute, error) {
+	type foundRoute struct {
+		route PaymentRoute
+		excl  RouteExclusions
+	}
+	var (
+		found   []foundRoute
+		seen    = map[string]struct{}{}
+		lastErr error
+	)
+	add := func(route PaymentRoute, excl RouteExclusions) {
+		key := routeKey(route)
+		if _, ok := seen[key]; ok {
+			return
+		}
+		seen[key] = struct{}{}
+		found = append(found, foundRoute{route, excl})
+	}
+
+	search = validatedSearch(search, msat)
+
+	// the best route from each source is searched concurrently
+	var (
+		wg         sync.WaitGroup
+		bestRoutes = make([]PaymentRoute, len(fromPubkeys))
+		bestErrs   = make([]error, len(fromPubkeys))
+	)
+	for i, fromPubkey := range fromPubkeys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bestRoutes[i], bestErrs[i] = search(ctx, fromPubkey, excl)
+		}()
+	}
+	wg.Wait()
+	for i, fromPubkey := range fromPubkeys {
+		if err := bestErrs[i]; err != nil {
+			log.Printf("no route from %s: %s\n", fromPubkey, err)
+			// the budget is the reason to report if any source hit it
+			if lastErr == nil || !errors.Is(lastErr, errNoRouteWithinBudget) {
+				lastErr = err
+			}
+			continue
+		}
+		add(bestRoutes[i], excl)
+	}
+	if len(found) == 0 && lastErr != nil {
+		return nil, stackerr.Wrap(lastErr)
+	}
+
+	for i := 0; i < len(found) && int64(len(found)) < maxRoutes; i++ {
+		base := found[i]
+		for _, hop := range base.route {
+			if int64(len(found)) >= maxRoutes || ctx.Err() != nil {
+				break
+			}
+			deviationExcl := base.excl.withChan(hop.ShortChannelId)
+			route, err := search(ctx, base.route[0].NodeId, deviationExcl)
+			if err != nil {
+				continue
+			}
+			add(route, deviationExcl)
+		}
+	}
+
+	routes := make([]PaymentRoute, 0, len(found))
+	for _, v := range found {
+		err := limits.check(v.route, msat)
+		if err != nil {
+			log.Println("discarding route:", err)
+			continue
+		}
+		routes = append(routes, v.route)
+	}
+	if len(routes) == 0 && len(found) > 0 {
+		return nil, stackerr.Wrap(errNoRouteWithinBudget)
+	}
+	sortRoutes(routes, msat)
+	if int64(len(routes)) > maxRoutes {
+		routes = routes[:maxRoutes]
+	}
+	return routes, nil
+}
+
+// validatedSearch checks the routes found by search, retrying with the
+// channels unable to forward the amount excluded
+func validatedSearch(search routeSearch, msat int64) routeSearch {
+	const nMaxAttempts = 3
+	return func(
+		ctx context.Context, fromPubkey string, excl RouteExclusions,
+	) (PaymentRoute, error) {
+		var invalidErr error
+		for range nMaxAttempts {
+			route, err := search(ctx, fromPubkey, excl)
+			if err != nil {
+				return nil, stackerr.Wrap(err)
+			}
+			var scid int64
+			scid, invalidErr = validateRoute(route, msat)
+			if invalidErr == nil {
+				return route, nil
+			}
+			log.Println("discarding invalid route:", invalidErr)
+			excl = excl.withChan(scid)
+		}
+		return nil, stackerr.Wrap(invalidErr)
+	}
+}
+
+// validateRoute checks that each hop is enabled and that the amount it
+// forwards is within its htlc limits. On failure, the short channel id of the
+// first failing hop is returned.
+func validateRoute(route PaymentRoute, msat int64) (int64, error) {
+	amounts := hopAmountsMsat(route, msat)
+	for i, hop := range route {
+		var reason string
+		switch {
+		case hop.Disabled:
+			reason = "disabled"
+		case amounts[i] < hop.HtlcMinimumMsat:
+			reason = fmt.Sprintf("below htlc minimum %d", hop.HtlcMinimumMsat)
+		case hop.HtlcMaximumMsat > 0 && amounts[i] > hop.HtlcMaximumMsat:
+			reason = fmt.Sprintf("above htlc maximum %d", hop.HtlcMaximumMsat)
+		default:
+			continue
+		}
+		return hop.ShortChannelId, fmt.Errorf(
+			"channel %s forwarding %d msat: %s",
+			shortChannelIdToString(hop.ShortChannelId), amounts[i], reason,
+		)
+	}
+	return 0, nil
+}
+
+// maxFeeMsat is the fee budget to deliver msat, the lowest of the absolute
+// and proportional limits, or 0 when unlimited
+func (l RouteLimits) maxFeeMsat(msat int64) int64 {
+	maxFee := l.MaxFeeMsat
+	if l.MaxFeePpm > 0 {
+		ppmFee := msat * l.MaxFeePpm / 1_000_000
+		if maxFee == 0 || ppmFee < maxFee {
+			maxFee = ppmFee
+		}
+	}
+	return maxFee
+}
+
+// check returns an error when the route to deliver msat exceeds a limit
+func (l RouteLimits) check(route PaymentRoute, msat int64) error {
+	if l.MaxHops > 0 && int64(len(route)) > l.MaxHops {
+		return fmt.Errorf("%d hops above maximum %d", len(route), l.MaxHops)
+	}
+	if cltv := routeCltv(route); l.MaxCltv > 0 && cltv > l.MaxCltv {
+		return fmt.Errorf("cltv %d above maximum %d", cltv, l.MaxCltv)
+	}
+	if l.MaxFeeMsat > 0 || l.MaxFeePpm > 0 {
+		maxFee := l.maxFeeMsat(msat)
+		if fee := routeFeeMsat(route, msat); fee > maxFee {
+			return fmt.Errorf("fee %d msat above maximum %d", fee, maxFee)
+		}
+	}
+	return nil
+}
+
+// routeKey identifies a route by its source and channels
+func routeKey(route PaymentRoute) string {
+	b := strings.Builder{}
+	if len(route) > 0 {
+		b.WriteString(route[0].NodeId)
+	}
+	for _, hop := range route {
+		b.WriteByte(':')
+		b.WriteString(strconv.FormatInt(hop.ShortChannelId, 10))
+	}
+	return b.String()
+}
+
+// hopFeeMsat is the fee charged by the hop node to forward msat through
+// the hop channel
+func hopFeeMsat(hop Hop, msat int64) int64 {
+	return int64(hop.FeeBaseMsat) +
+		msat*int64(hop.FeeProportionalMillionths)/1_000_000
+}
+
+// hopAmountsMsat returns the amount each hop forwards through its channel
+// to deliver msat to the destination
+func hopAmountsMsat(route PaymentRoute, msat int64) []int64 {
+	amounts := make([]int64, len(route))
+	amount := msat
+	for i := len(route) - 1; i >= 0; i-- {
+		amounts[i] = amount
+		amount += hopFeeMsat(route[i], amount)
+	}
+	return amounts
+}
+
+// routeFeeMsat is the total fee charged by the route hops to deliver msat
+// to the destination
+func routeFeeMsat(route PaymentRoute, msat int64) int64 {
+	amount := msat
+	for i := len(route) - 1; i >= 0; i-- {
+		amount += hopFeeMsat(route[i], amount)
+	}
+	return amount - msat
+}
+
+func routeCltv(route PaymentRoute) int64 {
+	var r int64
+	for _, hop := range route {
+		r += int64(hop.CltvExpiryDelta)
+	}
+	return r
+}
+
+// sortRoutes orders the routes by total fee, then by total cltv delta
+func sortRoutes(routes []PaymentRoute, msat int64) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		feeI := routeFeeMsat(routes[i], msat)
+		feeJ := routeFeeMsat(routes[j], msat)
+		if feeI != feeJ {
+			return feeI < feeJ
+		}
+		return routeCltv(routes[i]) < routeCltv(routes[j])
+	})
+}
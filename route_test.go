@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_routeFeeMsat(t *testing.T) {
+	route := PaymentRoute{
+		{FeeBaseMsat: 1000, FeeProportionalMillionths: 100},
+		{FeeBaseMsat: 0, FeeProportionalMillionths: 450},
+		{FeeBaseMsat: 0, FeeProportionalMillionths: 3000},
+	}
+	// 1_000_000 -> +3000 -> 1_003_000 -> +451 -> 1_003_451 -> +1100
+	var expected int64 = 4551
+
+	r := routeFeeMsat(route, 1_000_000)
+
+	if r != expected {
+		t.Fatal("unexpected:", r)
+	}
+}
+
+func Test_sortRoutes(t *testing.T) {
+	cheap := PaymentRoute{{FeeBaseMsat: 1000, CltvExpiryDelta: 144}}
+	cheapFast := PaymentRoute{{FeeBaseMsat: 1000, CltvExpiryDelta: 40}}
+	expensive := PaymentRoute{{FeeBaseMsat: 5000, CltvExpiryDelta: 9}}
+	routes := []PaymentRoute{expensive, cheap, cheapFast}
+	expected := []PaymentRoute{cheapFast, cheap, expensive}
+
+	sortRoutes(routes, 1_000_000)
+
+	if !reflect.DeepEqual(expected, routes) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, routes)
+	}
+}
+
+func Test_findAlternativeRoutes(t *testing.T) {
+	// a -(1)-> b -(2)-> d
+	// a -(3)-> c -(4)-> d
+	// a -(5)-> d
+	routes := []PaymentRoute{
+		{{NodeId: "a", ShortChannelId: 1}, {NodeId: "b", ShortChannelId: 2}},
+		{{NodeId: "a", ShortChannelId: 3, FeeBaseMsat: 10}, {NodeId: "c", ShortChannelId: 4}},
+		{{NodeId: "a", ShortChannelId: 5, FeeBaseMsat: 100}},
+	}
+	search := func(
+		_ context.Context, fromPubkey string, excl RouteExclusions,
+	) (PaymentRoute, error) {
+	next:
+		for _, route := range routes {
+			for _, hop := range route {
+				for _, scid := range excl.Chans {
+					if hop.ShortChannelId == scid {
+						continue next
+					}
+				}
+			}
+			return route, nil
+		}
+		return nil, fmt.Errorf("no route")
+	}
+
+	ctx := context.Background()
+	r, err := findAlternativeRoutes(
+		ctx, search, []string{"a"}, 1000, RouteExclusions{}, RouteLimits{}, 5,
+	)
+	tu.Must(t, err)
+
+	if !reflect.DeepEqual(routes, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", routes, r)
+	}
+
+	r, err = findAlternativeRoutes(
+		ctx, search, []string{"a"}, 1000, RouteExclusions{}, RouteLimits{}, 2,
+	)
+	tu.Must(t, err)
+
+	if !reflect.DeepEqual(routes[:2], r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", routes[:2], r)
+	}
+
+	r, err = findAlternativeRoutes(
+		ctx, search, []string{"a"}, 1000, RouteExclusions{},
+		RouteLimits{MaxHops: 1}, 5,
+	)
+	tu.Must(t, err)
+
+	if !reflect.DeepEqual(routes[2:], r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", routes[2:], r)
+	}
+
+	_, err = findAlternativeRoutes(
+		ctx, search, []string{"a"}, 1000, RouteExclusions{},
+		RouteLimits{MaxHops: 1, MaxFeePpm: 1000}, 5,
+	)
+	if !errors.Is(err, errNoRouteWithinBudget) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", errNoRouteWithinBudget, err)
+	}
+}
+
+func Test_routeLimitsCheck(t *testing.T) {
+	route := PaymentRoute{
+		{FeeBaseMsat: 1000, CltvExpiryDelta: 40},
+		{FeeProportionalMillionths: 1000, CltvExpiryDelta: 144},
+	}
+	// the route charges 2000 msat to deliver 1_000_000 msat
+	for i, v := range []struct {
+		limits RouteLimits
+		ok     bool
+	}{
+		{RouteLimits{}, true},
+		{RouteLimits{MaxFeeMsat: 2000, MaxFeePpm: 2000, MaxCltv: 184, MaxHops: 2}, true},
+		{RouteLimits{MaxFeeMsat: 1999}, false},
+		{RouteLimits{MaxFeeMsat: 5000, MaxFeePpm: 1999}, false},
+		{RouteLimits{MaxCltv: 183}, false},
+		{RouteLimits{MaxHops: 1}, false},
+	} {
+		err := v.limits.check(route, 1_000_000)
+		if (err == nil) != v.ok {
+			t.Fatalf("%d: expecting ok: %v\ngot: %+v\n", i, v.ok, err)
+		}
+	}
+}
+
+func Test_validateRoute(t *testing.T) {
+	route := PaymentRoute{
+		{ShortChannelId: 1, FeeBaseMsat: 1000, HtlcMaximumMsat: 2_000_000},
+		{ShortChannelId: 2, FeeProportionalMillionths: 3000, HtlcMaximumMsat: 1_000_000},
+	}
+
+	// the second hop forwards exactly the amount, the first one the amount
+	// plus the second hop fee
+	expectedAmounts := []int64{999_991, 997_000}
+	amounts := hopAmountsMsat(route, 997_000)
+	if !reflect.DeepEqual(expectedAmounts, amounts) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expectedAmounts, amounts)
+	}
+
+	_, err := validateRoute(route, 997_000)
+	tu.Must(t, err)
+
+	scid, err := validateRoute(route, 1_500_000)
+	if err == nil || scid != 2 {
+		t.Fatal("expecting the second hop above htlc maximum, got:", scid, err)
+	}
+
+	route[0].Disabled = true
+	scid, err = validateRoute(route, 997_000)
+	if err == nil || scid != 1 {
+		t.Fatal("expecting the first hop disabled, got:", scid, err)
+	}
+}
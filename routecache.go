@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// cachingRouter caches the routes of the next RouteFinder for a short time.
+// Requests with close amounts share the routes found for the upper bound of
+// their amount bucket, and concurrent identical requests share a single
+// search. The shared search outlives the request starting it, up to
+// searchTimeout, for the requests waiting on it.
+type cachingRouter struct {
+	next          RouteFinder
+	ttl           time.Duration
+	searchTimeout time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]routeCacheEntry
+	inflight  map[string]*routeFlight
+	lastSweep time.Time
+	hits      int64
+	misses    int64
+	shared    int64
+}
+
+type routeCacheEntry struct {
+	routes    []PaymentRoute
+	fetchTime time.Time
+}
+
+// routeFlight is a search in progress, done being closed once its result
+// is set
+type routeFlight struct {
+	done   chan struct{}
+	routes []PaymentRoute
+	err    error
+}
+
+func NewCachingRouter(
+	next RouteFinder, ttl time.Duration, searchTimeout time.Duration,
+) *cachingRouter {
+	return &cachingRouter{
+		next:          next,
+		ttl:           ttl,
+		searchTimeout: searchTimeout,
+		entries:       map[string]routeCacheEntry{},
+		inflight:      map[string]*routeFlight{},
+		lastSweep:     time.Now(),
+	}
+}
+
+func (cr *cachingRouter) FindRoutes(
+	ctx context.Context,
+	fromPubkeys []string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) ([]PaymentRoute, error) {
+	bucketMsat := amountBucketMsat(msat)
+	key := routeCacheKey(fromPubkeys, toPubkey, bucketMsat, excl, limits)
+
+	cr.mu.Lock()
+	entry, ok := cr.entries[key]
+	if ok && time.Since(entry.fetchTime) <= cr.ttl {
+		cr.hits++
+		cr.mu.Unlock()
+		return routesForAmount(entry.routes, msat, limits), nil
+	}
+	flight, ok := cr.inflight[key]
+	if ok {
+		cr.shared++
+	} else {
+		cr.misses++
+		flight = &routeFlight{done: make(chan struct{})}
+		cr.inflight[key] = flight
+	}
+	cr.mu.Unlock()
+
+	if !ok {
+		searchCtx, cancel := context.WithTimeout(
+			context.WithoutCancel(ctx), cr.searchTimeout,
+		)
+		go func() {
+			defer cancel()
+			cr.search(
+				searchCtx, key, flight, fromPubkeys, toPubkey, bucketMsat, excl, limits,
+			)
+		}()
+	}
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		return nil, stackerr.Wrap(ctx.Err())
+	}
+	if flight.err != nil {
+		return nil, stackerr.Wrap(flight.err)
+	}
+	return routesForAmount(flight.routes, msat, limits), nil
+}
+
+// search finds the routes of the flight, caching them on success
+func (cr *cachingRouter) search(
+	ctx context.Context,
+	key string,
+	flight *routeFlight,
+	fromPubkeys []string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) {
+	flight.routes, flight.err = cr.next.FindRoutes(
+		ctx, fromPubkeys, toPubkey, msat, excl, limits,
+	)
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	delete(cr.inflight, key)
+	close(flight.done)
+	if flight.err != nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(cr.lastSweep) > cr.ttl {
+		cr.sweep(now)
+	}
+	cr.entries[key] = routeCacheEntry{flight.routes, now}
+}
+
+func (cr *cachingRouter) sweep(now time.Time) {
+	for key, entry := range cr.entries {
+		if now.Sub(entry.fetchTime) > cr.ttl {
+			delete(cr.entries, key)
+		}
+	}
+	cr.lastSweep = now
+}
+
+// invalidateChan drops the cached routes through the channel
+func (cr *cachingRouter) invalidateChan(scid int64) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	for key, entry := range cr.entries {
+		for _, route := range entry.routes {
+			if slices.ContainsFunc(route, func(hop Hop) bool {
+				return hop.ShortChannelId == scid
+			}) {
+				delete(cr.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// ReportOutcomes invalidates the cached routes through the failed channels,
+// then forwards the outcomes
+func (cr *cachingRouter) ReportOutcomes(reporter string, outcomes []PaymentOutcome) error {
+	for _, v := range outcomes {
+		if v.Result != outcomeSuccess {
+			cr.invalidateChan(v.ShortChannelId)
+		}
+	}
+	or, ok := cr.next.(OutcomeReporter)
+	if !ok {
+		return nil
+	}
+	err := or.ReportOutcomes(reporter, outcomes)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (cr *cachingRouter) Stats() map[string]int64 {
+	stats := map[string]int64{}
+	if sr, ok := cr.next.(StatsReporter); ok {
+		stats = sr.Stats()
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	stats["routeCacheHits"] = cr.hits
+	stats["routeCacheMisses"] = cr.misses
+	stats["routeCacheShared"] = cr.shared
+	stats["routeCacheSize"] = int64(len(cr.entries))
+	return stats
+}
+
+// routesForAmount keeps the routes, found for the bucket amount, valid for
+// msat
+func routesForAmount(
+	routes []PaymentRoute, msat int64, limits RouteLimits,
+) []PaymentRoute {
+	r := make([]PaymentRoute, 0, len(routes))
+	for _, route := range routes {
+		_, err := validateRoute(route, msat)
+		if err == nil {
+			err = limits.check(route, msat)
+		}
+		if err != nil {
+			log.Println("discarding cached route:", err)
+			continue
+		}
+		r = append(r, route)
+	}
+	return r
+}
+
+// amountBucketMsat rounds msat up to its two most significant digits, so
+// that amounts less than 10% apart mostly share their routes
+func amountBucketMsat(msat int64) int64 {
+	unit := int64(1)
+	for msat/unit >= 100 {
+		unit *= 10
+	}
+	return (msat + unit - 1) / unit * unit
+}
+
+func routeCacheKey(
+	fromPubkeys []string,
+	toPubkey string,
+	bucketMsat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) string {
+	lowerSorted := func(v []string) []string {
+		r := make([]string, len(v))
+		for i := range v {
+			r[i] = strings.ToLower(v[i])
+		}
+		slices.Sort(r)
+		return r
+	}
+	chans := slices.Clone(excl.Chans)
+	slices.Sort(chans)
+	return fmt.Sprintf(
+		"%v|%s|%d|%v|%v|%+v",
+		lowerSorted(fromPubkeys), strings.ToLower(toPubkey), bucketMsat,
+		lowerSorted(excl.Nodes), chans, limits,
+	)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+// countingRouteFinder returns a single route, blocking until release is
+// closed or the context is done
+type countingRouteFinder struct {
+	mu      sync.Mutex
+	nCalls  int
+	release chan struct{}
+}
+
+func (c *countingRouteFinder) FindRoutes(
+	ctx context.Context,
+	_ []string,
+	_ string,
+	_ int64,
+	_ RouteExclusions,
+	_ RouteLimits,
+) ([]PaymentRoute, error) {
+	c.mu.Lock()
+	c.nCalls++
+	c.mu.Unlock()
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []PaymentRoute{{{NodeId: "a", ShortChannelId: 1}}}, nil
+}
+
+func Test_cachingRouter(t *testing.T) {
+	next := &countingRouteFinder{release: make(chan struct{})}
+	cr := NewCachingRouter(next, time.Minute, time.Minute)
+	ctx := context.Background()
+	find := func(msat int64) {
+		r, err := cr.FindRoutes(ctx, []string{"a"}, "b", msat, RouteExclusions{}, RouteLimits{})
+		tu.Must(t, err)
+		if len(r) != 1 {
+			t.Fatalf("expecting: %+v\ngot: %+v\n", 1, len(r))
+		}
+	}
+
+	// concurrent requests in the same amount bucket share the search
+	var wg sync.WaitGroup
+	for _, msat := range []int64{101_000, 105_000} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			find(msat)
+		}()
+	}
+	for {
+		cr.mu.Lock()
+		waiting := cr.misses+cr.shared == 2
+		cr.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(next.release)
+	wg.Wait()
+
+	find(109_000)
+	if next.nCalls != 1 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 1, next.nCalls)
+	}
+
+	// a failure through the cached route invalidates it
+	tu.Must(t, cr.ReportOutcomes("w1", []PaymentOutcome{
+		{1, 0, 100_000, outcomeTemporaryChannelFailure},
+	}))
+	find(105_000)
+	if next.nCalls != 2 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 2, next.nCalls)
+	}
+}
+
+func Test_cachingRouterLeaderCanceled(t *testing.T) {
+	next := &countingRouteFinder{release: make(chan struct{})}
+	cr := NewCachingRouter(next, time.Minute, time.Minute)
+	find := func(ctx context.Context) ([]PaymentRoute, error) {
+		return cr.FindRoutes(ctx, []string{"a"}, "b", 100_000, RouteExclusions{}, RouteLimits{})
+	}
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := find(leaderCtx)
+		leaderErr <- err
+	}()
+	waiterErr := make(chan error)
+	go func() {
+		for {
+			cr.mu.Lock()
+			started := cr.misses == 1
+			cr.mu.Unlock()
+			if started {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		r, err := find(context.Background())
+		if err == nil && len(r) != 1 {
+			err = fmt.Errorf("unexpected routes: %+v", r)
+		}
+		waiterErr <- err
+	}()
+	for {
+		cr.mu.Lock()
+		waiting := cr.shared == 1
+		cr.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the leader gives up, the shared search goes on for the waiter
+	cancel()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", context.Canceled, err)
+	}
+	close(next.release)
+	tu.Must(t, <-waiterErr)
+	if next.nCalls != 1 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 1, next.nCalls)
+	}
+}
+
+func Test_amountBucketMsat(t *testing.T) {
+	for msat, expected := range map[int64]int64{
+		99:        99,
+		100_000:   100_000,
+		100_001:   110_000,
+		1_234_567: 1_300_000,
+	} {
+		if r := amountBucketMsat(msat); r != expected {
+			t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+		}
+	}
+}
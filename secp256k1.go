@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// secp256k1 curve parameters, y² = x³ + 7 over the field of order p
+var (
+	secpP, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+	secpN, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	secpGx, _ = new(big.Int).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+	secpGy, _ = new(big.Int).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+)
+
+// secpPoint is an affine curve point, the point at infinity having nil
+// coordinates
+type secpPoint struct {
+	x, y *big.Int
+}
+
+func (p secpPoint) isInfinity() bool {
+	return p.x == nil
+}
+
+func secpAdd(a, b secpPoint) secpPoint {
+	if a.isInfinity() {
+		return b
+	}
+	if b.isInfinity() {
+		return a
+	}
+	var slope *big.Int
+	if a.x.Cmp(b.x) == 0 {
+		sum := new(big.Int).Add(a.y, b.y)
+		if sum.Mod(sum, secpP).Sign() == 0 {
+			return secpPoint{}
+		}
+		// tangent slope 3x² / 2y
+		num := new(big.Int).Mul(a.x, a.x)
+		num.Mul(num, big.NewInt(3))
+		den := new(big.Int).Lsh(a.y, 1)
+		slope = num.Mul(num, den.ModInverse(den, secpP))
+	} else {
+		num := new(big.Int).Sub(b.y, a.y)
+		den := new(big.Int).Sub(b.x, a.x)
+		den.Mod(den, secpP)
+		slope = num.Mul(num, den.ModInverse(den, secpP))
+	}
+	slope.Mod(slope, secpP)
+
+	x := new(big.Int).Mul(slope, slope)
+	x.Sub(x, a.x).Sub(x, b.x).Mod(x, secpP)
+	y := new(big.Int).Sub(a.x, x)
+	y.Mul(y, slope).Sub(y, a.y).Mod(y, secpP)
+	return secpPoint{x, y}
+}
+
+func secpMul(p secpPoint, k *big.Int) secpPoint {
+	r := secpPoint{}
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = secpAdd(r, r)
+		if k.Bit(i) == 1 {
+			r = secpAdd(r, p)
+		}
+	}
+	return r
+}
+
+// secpRecoverPubkey recovers the compressed public key of the signer of
+// hash from the 64 bytes compact signature and its recovery id
+func secpRecoverPubkey(hash []byte, sig []byte, recId byte) ([]byte, error) {
+	if len(sig) != 64 || recId > 3 {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if r.Sign() == 0 || r.Cmp(secpN) >= 0 || s.Sign() == 0 || s.Cmp(secpN) >= 0 {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	// R is the signature nonce point, x being r, possibly overflowed
+	x := new(big.Int).Set(r)
+	if recId&2 != 0 {
+		x.Add(x, secpN)
+		if x.Cmp(secpP) >= 0 {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	}
+	alpha := new(big.Int).Exp(x, big.NewInt(3), secpP)
+	alpha.Add(alpha, big.NewInt(7)).Mod(alpha, secpP)
+	// p ≡ 3 mod 4, so the square root is alpha^((p+1)/4)
+	exp := new(big.Int).Add(secpP, big.NewInt(1))
+	exp.Rsh(exp, 2)
+	y := new(big.Int).Exp(alpha, exp, secpP)
+	if new(big.Int).Exp(y, big.NewInt(2), secpP).Cmp(alpha) != 0 {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	if y.Bit(0) != uint(recId&1) {
+		y.Sub(secpP, y)
+	}
+	rPoint := secpPoint{x, y}
+
+	// Q = r⁻¹(sR - eG)
+	e := new(big.Int).SetBytes(hash)
+	e.Mod(e, secpN)
+	negE := new(big.Int).Sub(secpN, e)
+	negE.Mod(negE, secpN)
+	rInv := new(big.Int).ModInverse(r, secpN)
+	q := secpAdd(
+		secpMul(rPoint, s),
+		secpMul(secpPoint{secpGx, secpGy}, negE),
+	)
+	q = secpMul(q, rInv)
+	if q.isInfinity() {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	pubkey := make([]byte, 33)
+	pubkey[0] = 0x02 + byte(q.y.Bit(0))
+	q.x.FillBytes(pubkey[1:])
+	return pubkey, nil
+}
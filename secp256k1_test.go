@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_secpRecoverPubkey(t *testing.T) {
+	// sha256 of "golympus"
+	hash, err := hex.DecodeString(
+		"aa1ef0de5feca7c6d700988f95f89f9ac629a735fa8753dd16d3c92258330656",
+	)
+	tu.Must(t, err)
+	// the signature nonce points of the overflowed vectors have an x above
+	// the curve order, r being x - n
+	payload := []struct {
+		sig    string
+		recId  byte
+		pubkey string
+	}{
+		{
+			"97855f402631f09e602e5ccadc219503f07cdd4c73b2215b5418f52a7fdbfcd9d93cdcf433da3284c8801cdcff2ece339e8ef1bfd3dfc65a4c31a9945a14163c",
+			0,
+			"02bb50e2d89a4ed70663d080659fe0ad4b9bc3e06c17a227433966cb59ceee020d",
+		},
+		{
+			"000000000000000000000000000000000000000000000000000000000000000200000000000000000000000000000000000000000000000000000000003c1a2b",
+			2,
+			"0387dfe6899dc7f879207e27cf1b448fe3aedd0745637b54a9f599f05ac62912cf",
+		},
+		{
+			"000000000000000000000000000000000000000000000000000000000000000200000000000000000000000000000000000000000000000000000000003c1a2b",
+			3,
+			"038d1ba94ba0d97f825d0fcba038b12e1a0e8e6f32c1fa2f822728581a99a33da6",
+		},
+	}
+	for i, v := range payload {
+		sig, err := hex.DecodeString(v.sig)
+		tu.MustIdx(t, i, err)
+		r, err := secpRecoverPubkey(hash, sig, v.recId)
+		tu.MustIdx(t, i, err)
+		if hex.EncodeToString(r) != v.pubkey {
+			t.Fatalf("expecting: %+v\ngot: %+v\n", v.pubkey, hex.EncodeToString(r))
+		}
+	}
+
+	const (
+		valid = "97855f402631f09e602e5ccadc219503f07cdd4c73b2215b5418f52a7fdbfcd9d93cdcf433da3284c8801cdcff2ece339e8ef1bfd3dfc65a4c31a9945a14163c"
+		order = "fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141"
+	)
+	invalid := []struct {
+		sig   string
+		recId byte
+	}{
+		// r + n beyond the field order
+		{valid, 2},
+		{valid[:126], 0},
+		{valid, 4},
+		{order + valid[64:], 0},
+		{valid[:64] + order, 0},
+		{valid[:64] + "0000000000000000000000000000000000000000000000000000000000000000", 0},
+		// no curve point with x = 5
+		{"0000000000000000000000000000000000000000000000000000000000000005" + valid[64:], 0},
+	}
+	for i, v := range invalid {
+		sig, err := hex.DecodeString(v.sig)
+		tu.MustIdx(t, i, err)
+		if _, err := secpRecoverPubkey(hash, sig, v.recId); err == nil {
+			t.Fatal("expecting an error for", i)
+		}
+	}
+}
@@ -1,25 +1,71 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"master.private/bstd.git/stackerr"
 )
 
 type server struct {
-	pf PriceFetcher
-	ff FeerateFetcher
-	rf RouteFinder
+	pf           PriceFetcher
+	ff           FeerateFetcher
+	rf           RouteFinder
+	routeTimeout time.Duration
+	// maxRoutes caps the routes combined from several searches
+	maxRoutes int64
+	// channels toward the blinded paths peers, nil for backends without
+	// channel graph
+	il inboundChannelLister
+	// nr is nil for backends without channel graph
+	nr *nodeRecommender
+	// gl is nil for backends unable to describe channels and nodes
+	gl graphLookup
+	// multi-part payments bounds
+	mppMinShardMsat int64
+	mppMaxParts     int64
+	reportLimiter   *rateLimiter
+	// reportClientHeader is the header a trusted proxy sets to the client
+	// address, empty when the clients connect directly
+	reportClientHeader string
 }
 
-func newServer(pf PriceFetcher, ff FeerateFetcher, rf RouteFinder) *server {
+func newServer(
+	pf PriceFetcher,
+	ff FeerateFetcher,
+	rf RouteFinder,
+	il inboundChannelLister,
+	nr *nodeRecommender,
+	gl graphLookup,
+	routeTimeout time.Duration,
+	maxRoutes int64,
+	mppMinShardMsat int64,
+	mppMaxParts int64,
+	reportClientHeader string,
+) *server {
 	return &server{
-		pf: pf,
-		ff: ff,
-		rf: rf,
+		pf:              pf,
+		ff:              ff,
+		rf:              rf,
+		il:              il,
+		nr:              nr,
+		gl:              gl,
+		routeTimeout:    routeTimeout,
+		maxRoutes:       maxRoutes,
+		mppMinShardMsat: mppMinShardMsat,
+		mppMaxParts:     mppMaxParts,
+		reportLimiter:   newRateLimiter(reportInterval, reportBurst),
+
+		reportClientHeader: reportClientHeader,
 	}
 }
 
@@ -71,16 +117,173 @@ func (s *server) routesplusHandler(
 	}
 	log.Printf("-> %+v", params)
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	if !validHopVersion(params.HopVersion) {
+		return writeErrorResult(w, http.StatusBadRequest, errUnsupportedHopVersion)
+	}
+	if len(params.From) > maxSources {
+		return writeErrorResult(w, http.StatusBadRequest, errTooManySources)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.routeTimeout)
+	defer cancel()
+	if params.Mpp {
+		parts, err := splitPayment(
+			ctx, s.rf, params.From, params.To, params.Sat*1000,
+			params.exclusions(), params.limits(),
+			s.mppMinShardMsat, s.mppMaxParts,
+		)
+		serialized, serializeErr := serializeParts(parts, params.HopVersion)
+		if serializeErr != nil {
+			return stackerr.Wrap(serializeErr)
+		}
+		return writeSearchResult(w, serialized, err)
+	}
+	routes, err := s.rf.FindRoutes(
+		ctx, params.From, params.To, params.Sat*1000,
+		params.exclusions(), params.limits(),
+	)
+	serialized, serializeErr := serializeRoutesVersion(
+		routes, params.Sat*1000, params.HopVersion,
+	)
+	if serializeErr != nil {
+		return stackerr.Wrap(serializeErr)
+	}
+	return writeSearchResult(w, serialized, err)
+}
+
+func (s *server) invoiceRoutesHandler(
+	w http.ResponseWriter, r *http.Request,
+) error {
+	log.Println("request on POST /router/invoiceroutes")
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err := r.ParseForm()
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	params, err := decodeInRoutes([]byte(r.PostFormValue("params")))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	log.Printf("-> %+v", params)
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	if !validHopVersion(params.HopVersion) {
+		return writeErrorResult(w, http.StatusBadRequest, errUnsupportedHopVersion)
+	}
+	if len(params.From) > maxSources {
+		return writeErrorResult(w, http.StatusBadRequest, errTooManySources)
+	}
+
+	inv, err := decodeInvoice(params.Invoice)
+	if err != nil {
+		log.Println("error decoding invoice: ", err)
+		return writeErrorResult(w, http.StatusBadRequest, errInvalidInvoice)
+	}
+	// the requested amount is only used for invoices without amount
+	msat := inv.AmountMsat
+	if msat == 0 {
+		msat = params.Sat * 1000
+	}
+	if msat <= 0 {
+		return writeErrorResult(w, http.StatusBadRequest, errInvalidInvoice)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.routeTimeout)
+	defer cancel()
+	routes, err := findInvoiceRoutes(
+		ctx, s.rf, params.From, inv, msat, params.exclusions(), params.limits(),
+		s.maxRoutes,
+	)
+	serialized, serializeErr := serializeRoutesVersion(
+		routes, msat, params.HopVersion,
+	)
+	if serializeErr != nil {
+		return stackerr.Wrap(serializeErr)
+	}
+	return writeSearchResult(w, serialized, err)
+}
 
-	routes, err := s.rf.FindRoutes(params.From, params.To, params.Sat*1000)
+func (s *server) channelHandler(w http.ResponseWriter, r *http.Request) error {
+	log.Println("request on GET /router/channel/" + r.PathValue("id"))
+	w.Header().Set("Content-Type", "application/json")
+	scid, err := parseShortChannelId(r.PathValue("id"))
+	if err != nil {
+		return writeErrorResult(w, http.StatusBadRequest, errInvalidShortChannelId)
+	}
+	if s.gl == nil {
+		return writeErrorResult(w, http.StatusNotImplemented, errLookupUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.routeTimeout)
+	defer cancel()
+	info, err := s.gl.lookupChannel(ctx, scid)
+	return writeLookupResult(w, info, err)
+}
+
+func (s *server) nodeHandler(w http.ResponseWriter, r *http.Request) error {
+	log.Println("request on GET /router/node/" + r.PathValue("id"))
+	w.Header().Set("Content-Type", "application/json")
+	nodeId := strings.ToLower(r.PathValue("id"))
+	if b, err := hex.DecodeString(nodeId); err != nil || len(b) != 33 {
+		return writeErrorResult(w, http.StatusBadRequest, errInvalidNodeId)
+	}
+	if s.gl == nil {
+		return writeErrorResult(w, http.StatusNotImplemented, errLookupUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.routeTimeout)
+	defer cancel()
+	info, err := s.gl.lookupNode(ctx, nodeId)
+	return writeLookupResult(w, info, err)
+}
+
+// writeLookupResult writes the channel or node found in the olympus
+// response format
+func writeLookupResult(w http.ResponseWriter, found interface{}, err error) error {
+	switch {
+	case errors.Is(err, errUnknownChannel):
+		return writeErrorResult(w, http.StatusNotFound, errUnknownChannel)
+	case errors.Is(err, errUnknownNode):
+		return writeErrorResult(w, http.StatusNotFound, errUnknownNode)
+	case errors.Is(err, errLnUnavailable):
+		log.Println("error looking up, lightning node unavailable: ", err)
+		return writeErrorResult(w, http.StatusServiceUnavailable, errLnUnavailable)
+	case err != nil:
+		return stackerr.Wrap(err)
+	}
+	result := []interface{}{
+		"ok",
+		found,
+	}
+	log.Printf("<- %+v\n", result)
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// writeSearchResult writes the serialized routes found, or the error
+// preventing the search, in the olympus response format
+func writeSearchResult(
+	w http.ResponseWriter, found interface{}, err error,
+) error {
+	if errors.Is(err, errNoRouteWithinBudget) {
+		log.Println("error getting routes: ", err)
+		return writeErrorResult(w, http.StatusOK, errNoRouteWithinBudget)
+	}
+	if errors.Is(err, errNoMppSplit) {
+		log.Println("error getting routes: ", err)
+		return writeErrorResult(w, http.StatusOK, errNoMppSplit)
+	}
+	if errors.Is(err, errLnUnavailable) {
+		log.Println("error getting routes, lightning node unavailable: ", err)
+		return writeErrorResult(w, http.StatusServiceUnavailable, errLnUnavailable)
+	}
 	if err != nil {
 		log.Println("error getting routes, returning empty routes: ", err)
-		routes = []PaymentRoute{}
 	}
 
 	result := []interface{}{
 		"ok",
-		serializeRoutes(routes),
+		found,
 	}
 	log.Printf("<- %+v\n", result)
 	err = json.NewEncoder(w).Encode(result)
@@ -90,6 +293,122 @@ func (s *server) routesplusHandler(
 	return nil
 }
 
+// writeErrorResult writes the error in the olympus response format
+func writeErrorResult(w http.ResponseWriter, statusCode int, cause error) error {
+	result := []interface{}{
+		"error",
+		cause.Error(),
+	}
+	log.Printf("<- %+v\n", result)
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// reports bounds, each client being allowed a burst of reports, then one
+// report every interval
+const (
+	maxReportBytes    = 16 << 10
+	maxReportOutcomes = 64
+	reportBurst       = 20
+	reportInterval    = 3 * time.Second
+)
+
+func (s *server) reportHandler(w http.ResponseWriter, r *http.Request) error {
+	log.Println("request on POST /router/report")
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	// the clients are told apart by address, to rate limit them and to
+	// count the independent reports of a channel
+	reporter := s.reportClient(r)
+	if !s.reportLimiter.allow(reporter, time.Now()) {
+		return writeErrorResult(w, http.StatusTooManyRequests, errors.New("too many reports"))
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxReportBytes)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err := r.ParseForm()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return writeErrorResult(w, http.StatusRequestEntityTooLarge, err)
+	}
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	var outcomes []PaymentOutcome
+	err = decodeHexJson([]byte(r.PostFormValue("params")), &outcomes)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	log.Printf("-> %+v", outcomes)
+	if len(outcomes) > maxReportOutcomes {
+		return writeErrorResult(w, http.StatusBadRequest, fmt.Errorf(
+			"%d outcomes above maximum %d", len(outcomes), maxReportOutcomes,
+		))
+	}
+	for _, v := range outcomes {
+		if (v.Direction != 0 && v.Direction != 1) || v.AmountMsat <= 0 {
+			return writeErrorResult(w, http.StatusBadRequest, fmt.Errorf(
+				"invalid outcome %+v, expecting direction 0 or 1 and a positive amount", v,
+			))
+		}
+	}
+
+	or, ok := s.rf.(OutcomeReporter)
+	if !ok {
+		return writeErrorResult(w, http.StatusNotFound, errors.New("reports not supported"))
+	}
+	err = or.ReportOutcomes(reporter, outcomes)
+	if errors.Is(err, errUnknownOutcome) {
+		return writeErrorResult(w, http.StatusBadRequest, err)
+	}
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	result := []interface{}{"ok"}
+	log.Printf("<- %+v\n", result)
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// reportClient is the address of the reporting client, given by the trusted
+// proxy header when configured. Behind a proxy, RemoteAddr is the proxy.
+func (s *server) reportClient(r *http.Request) string {
+	if s.reportClientHeader != "" {
+		// a proxy appending to a list, like X-Forwarded-For, appends last
+		values := strings.Split(r.Header.Get(s.reportClientHeader), ",")
+		if client := strings.TrimSpace(values[len(values)-1]); client != "" {
+			return client
+		}
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return client
+}
+
+func (s *server) statsHandler(w http.ResponseWriter, _ *http.Request) error {
+	log.Println("request on GET /stats")
+	w.Header().Set("Content-Type", "application/json")
+
+	stats := map[string]int64{}
+	if sr, ok := s.rf.(StatsReporter); ok {
+		stats = sr.Stats()
+	}
+	err := json.NewEncoder(w).Encode(stats)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
 type PriceFetcher interface {
 	FetchPrice(symbols ...Symbol) (map[Symbol]float64, error)
 }
@@ -100,14 +419,71 @@ type FeerateFetcher interface {
 
 type RouteFinder interface {
 	FindRoutes(
-		fromPubkeys []string, toPubkey string, msat int64,
+		ctx context.Context,
+		fromPubkeys []string,
+		toPubkey string,
+		msat int64,
+		excl RouteExclusions,
+		limits RouteLimits,
 	) ([]PaymentRoute, error)
 }
 
+// StatsReporter is implemented by the components exposing runtime counters
+type StatsReporter interface {
+	Stats() map[string]int64
+}
+
+// RouteExclusions are the nodes and channels that must not be part of any
+// returned route. Channels are excluded in both directions.
+type RouteExclusions struct {
+	Nodes []string
+	Chans []int64
+}
+
+// withChan returns a copy of the exclusions including the channel
+func (e RouteExclusions) withChan(scid int64) RouteExclusions {
+	chans := make([]int64, 0, len(e.Chans)+1)
+	chans = append(chans, e.Chans...)
+	chans = append(chans, scid)
+	return RouteExclusions{Nodes: e.Nodes, Chans: chans}
+}
+
+// RouteLimits are the client budgets every returned route must satisfy.
+// Zero values are unlimited. Each backend passes the ones it supports to its
+// search, and the found routes are checked against all of them.
+type RouteLimits struct {
+	MaxFeeMsat int64
+	MaxFeePpm  int64
+	MaxCltv    int64
+	MaxHops    int64
+}
+
 type inRoutes struct {
-	Sat      int64    `json:"sat"`
-	BadNodes []string `json:"badNodes"`
-	BadChans []int64  `json:"badChans"`
-	From     []string `json:"from"`
-	To       string   `json:"to"`
+	Sat        int64    `json:"sat"`
+	BadNodes   []string `json:"badNodes"`
+	BadChans   []int64  `json:"badChans"`
+	From       []string `json:"from"`
+	To         string   `json:"to"`
+	MaxFeeMsat int64    `json:"maxFeeMsat"`
+	MaxFeePpm  int64    `json:"maxFeePpm"`
+	MaxCltv    int64    `json:"maxCltv"`
+	MaxHops    int64    `json:"maxHops"`
+	Invoice    string   `json:"invoice"`
+	// Mpp splits the amount over several routes
+	Mpp bool `json:"mpp"`
+	// HopVersion selects the hop serialization, the legacy one by default
+	HopVersion int64 `json:"hopVersion"`
+}
+
+func (in inRoutes) exclusions() RouteExclusions {
+	return RouteExclusions{Nodes: in.BadNodes, Chans: in.BadChans}
+}
+
+func (in inRoutes) limits() RouteLimits {
+	return RouteLimits{
+		MaxFeeMsat: in.MaxFeeMsat,
+		MaxFeePpm:  in.MaxFeePpm,
+		MaxCltv:    in.MaxCltv,
+		MaxHops:    in.MaxHops,
+	}
 }
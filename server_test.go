@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+// reportRecorder is a route finder keeping the reported outcomes
+type reportRecorder struct {
+	listRouteFinder
+	reports map[string][]PaymentOutcome
+}
+
+func (rr *reportRecorder) ReportOutcomes(reporter string, outcomes []PaymentOutcome) error {
+	rr.reports[reporter] = append(rr.reports[reporter], outcomes...)
+	return nil
+}
+
+func Test_reportHandler(t *testing.T) {
+	rr := &reportRecorder{reports: map[string][]PaymentOutcome{}}
+	s := newServer(nil, nil, rr, nil, nil, nil, time.Second, 3, 0, 0, "")
+	report := func(remoteAddr string, params string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(
+			"POST", "/router/report",
+			strings.NewReader(url.Values{"params": {params}}.Encode()),
+		)
+		r.RemoteAddr = remoteAddr
+		tu.Must(t, s.reportHandler(w, r))
+		return w.Code
+	}
+	outcomes := func(n int) string {
+		b := strings.Repeat(`{"scid":1,"direction":0,"amountMsat":1000,"result":"success"},`, n)
+		return hex.EncodeToString([]byte("[" + strings.TrimSuffix(b, ",") + "]"))
+	}
+
+	if code := report("192.0.2.1:1234", outcomes(2)); code != http.StatusOK {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusOK, code)
+	}
+	// the reporter is the client address
+	if n := len(rr.reports["192.0.2.1"]); n != 2 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 2, n)
+	}
+
+	if code := report("192.0.2.1:1234", outcomes(maxReportOutcomes+1)); code != http.StatusBadRequest {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusBadRequest, code)
+	}
+	if code := report("192.0.2.1:1234", strings.Repeat("0", maxReportBytes)); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusRequestEntityTooLarge, code)
+	}
+
+	// the burst is spent by the reports above, other clients are unaffected
+	for range reportBurst - 3 {
+		report("192.0.2.1:1234", outcomes(1))
+	}
+	if code := report("192.0.2.1:1234", outcomes(1)); code != http.StatusTooManyRequests {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusTooManyRequests, code)
+	}
+	if code := report("192.0.2.2:1234", outcomes(1)); code != http.StatusOK {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusOK, code)
+	}
+
+	invalid := []string{
+		`[{"scid":1,"direction":2,"amountMsat":1000,"result":"success"}]`,
+		`[{"scid":1,"direction":0,"amountMsat":0,"result":"success"}]`,
+	}
+	for i, v := range invalid {
+		code := report("192.0.2.3:1234", hex.EncodeToString([]byte(v)))
+		if code != http.StatusBadRequest {
+			t.Fatalf("%d: expecting: %+v\ngot: %+v\n", i, http.StatusBadRequest, code)
+		}
+	}
+
+	// behind a proxy, the reporter is the client address it sets
+	s = newServer(nil, nil, rr, nil, nil, nil, time.Second, 3, 0, 0, "X-Forwarded-For")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(
+		"POST", "/router/report",
+		strings.NewReader(url.Values{"params": {outcomes(1)}}.Encode()),
+	)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 198.51.100.2")
+	tu.Must(t, s.reportHandler(w, r))
+	if n := len(rr.reports["198.51.100.2"]); n != 1 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 1, n)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// inRoutesV2 is the json body of the v2 routes request
+type inRoutesV2 struct {
+	From            []string `json:"from"`
+	To              string   `json:"to"`
+	AmountMsat      int64    `json:"amountMsat"`
+	ExcludeNodes    []string `json:"excludeNodes"`
+	ExcludeChannels []int64  `json:"excludeChannels"`
+	MaxFeeMsat      int64    `json:"maxFeeMsat"`
+	MaxFeePpm       int64    `json:"maxFeePpm"`
+	MaxCltv         int64    `json:"maxCltv"`
+	MaxHops         int64    `json:"maxHops"`
+}
+
+func (in inRoutesV2) exclusions() RouteExclusions {
+	return RouteExclusions{Nodes: in.ExcludeNodes, Chans: in.ExcludeChannels}
+}
+
+func (in inRoutesV2) limits() RouteLimits {
+	return RouteLimits{
+		MaxFeeMsat: in.MaxFeeMsat,
+		MaxFeePpm:  in.MaxFeePpm,
+		MaxCltv:    in.MaxCltv,
+		MaxHops:    in.MaxHops,
+	}
+}
+
+type outRoutesV2 struct {
+	Routes []outRouteV2 `json:"routes"`
+}
+
+type outRouteV2 struct {
+	// Source is the node forwarding through the first channel
+	Source     string     `json:"source"`
+	AmountMsat int64      `json:"amountMsat"`
+	FeeMsat    int64      `json:"feeMsat"`
+	Cltv       int64      `json:"cltv"`
+	Hops       []outHopV2 `json:"hops"`
+}
+
+// outHopV2 is a hop with the amount it forwards through its channel
+type outHopV2 struct {
+	Hop
+	AmountMsat int64 `json:"amountMsat"`
+}
+
+// inTrampolineV2 is the json body of the v2 trampoline request, the limits
+// covering both legs of the payment
+type inTrampolineV2 struct {
+	inRoutesV2
+	Trampoline string `json:"trampoline"`
+}
+
+// outTrampolineV2 has what the wallet needs to build the trampoline onion:
+// the routes paying trampolineAmountMsat to the trampoline node, which
+// forwards amountMsat to the destination within trampolineCltvExpiryDelta
+type outTrampolineV2 struct {
+	Trampoline                string       `json:"trampoline"`
+	AmountMsat                int64        `json:"amountMsat"`
+	TrampolineAmountMsat      int64        `json:"trampolineAmountMsat"`
+	TrampolineFeeMsat         int64        `json:"trampolineFeeMsat"`
+	TrampolineCltvExpiryDelta int64        `json:"trampolineCltvExpiryDelta"`
+	Routes                    []outRouteV2 `json:"routes"`
+	// InnerRoute is the trampoline to destination route the fee and cltv
+	// delta were computed from
+	InnerRoute *outRouteV2 `json:"innerRoute"`
+}
+
+// inBlindedPathsV2 is the json body of the v2 blinded paths request, peers
+// being the nodes the wallet has channels with
+type inBlindedPathsV2 struct {
+	Peers      []string `json:"peers"`
+	AmountMsat int64    `json:"amountMsat"`
+	MaxPaths   int64    `json:"maxPaths"`
+}
+
+// outBlindedPathsV2 has the paths from the introduction nodes to the peers.
+// The wallet adds the policy of its channel with the peer, unknown to the
+// public graph, before building each blinded path.
+type outBlindedPathsV2 struct {
+	Paths []blindedPath `json:"paths"`
+}
+
+type outRecommendedNodesV2 struct {
+	Nodes []nodeRecommendation `json:"nodes"`
+}
+
+type outErrorV2 struct {
+	Error string `json:"error"`
+}
+
+func (s *server) routesV2Handler(w http.ResponseWriter, r *http.Request) error {
+	log.Println("request on POST /v2/router/routes")
+	w.Header().Set("Content-Type", "application/json")
+
+	var params inRoutesV2
+	if statusCode, err := decodeRequestV2(w, r, &params); err != nil {
+		return writeJson(w, statusCode, outErrorV2{err.Error()})
+	}
+	if params.To == "" || params.AmountMsat <= 0 {
+		return writeJson(w, http.StatusBadRequest, outErrorV2{
+			"to and a positive amountMsat are required",
+		})
+	}
+	if len(params.From) > maxSources {
+		return writeJson(w, http.StatusBadRequest, outErrorV2{errTooManySources.Error()})
+	}
+	log.Printf("-> %+v", params)
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.routeTimeout)
+	defer cancel()
+	routes, err := s.rf.FindRoutes(
+		ctx, params.From, params.To, params.AmountMsat,
+		params.exclusions(), params.limits(),
+	)
+	if statusCode, failure := searchFailureV2(err); failure != nil {
+		return writeJson(w, statusCode, failure)
+	} else if err != nil {
+		routes = nil
+	}
+
+	result := outRoutesV2{Routes: make([]outRouteV2, 0, len(routes))}
+	for _, route := range routes {
+		result.Routes = append(result.Routes, toOutRouteV2(route, params.AmountMsat))
+	}
+	return writeJson(w, http.StatusOK, result)
+}
+
+func (s *server) trampolineV2Handler(w http.ResponseWriter, r *http.Request) error {
+	log.Println("request on POST /v2/router/trampoline")
+	w.Header().Set("Content-Type", "application/json")
+
+	var params inTrampolineV2
+	if statusCode, err := decodeRequestV2(w, r, &params); err != nil {
+		return writeJson(w, statusCode, outErrorV2{err.Error()})
+	}
+	if params.To == "" || params.Trampoline == "" || params.AmountMsat <= 0 {
+		return writeJson(w, http.StatusBadRequest, outErrorV2{
+			"to, trampoline and a positive amountMsat are required",
+		})
+	}
+	if len(params.From) > maxSources {
+		return writeJson(w, http.StatusBadRequest, outErrorV2{errTooManySources.Error()})
+	}
+	log.Printf("-> %+v", params)
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.routeTimeout)
+	defer cancel()
+	payment, err := findTrampolinePayment(
+		ctx, s.rf, params.From, params.Trampoline, params.To, params.AmountMsat,
+		params.exclusions(), params.limits(),
+	)
+	if statusCode, failure := searchFailureV2(err); failure != nil {
+		return writeJson(w, statusCode, failure)
+	}
+
+	result := outTrampolineV2{
+		Trampoline: params.Trampoline,
+		AmountMsat: params.AmountMsat,
+		Routes:     []outRouteV2{},
+	}
+	if err != nil {
+		return writeJson(w, http.StatusOK, result)
+	}
+	innerRoute := toOutRouteV2(payment.InnerRoute, params.AmountMsat)
+	result.TrampolineAmountMsat = params.AmountMsat + payment.TrampolineFeeMsat
+	result.TrampolineFeeMsat = payment.TrampolineFeeMsat
+	result.TrampolineCltvExpiryDelta = payment.TrampolineCltv
+	result.InnerRoute = &innerRoute
+	for _, route := range payment.Routes {
+		result.Routes = append(
+			result.Routes, toOutRouteV2(route, result.TrampolineAmountMsat),
+		)
+	}
+	return writeJson(w, http.StatusOK, result)
+}
+
+func (s *server) blindedPathsV2Handler(w http.ResponseWriter, r *http.Request) error {
+	const (
+		defaultMaxPaths = 3
+		maxMaxPaths     = 10
+	)
+	log.Println("request on POST /v2/router/blindedpaths")
+	w.Header().Set("Content-Type", "application/json")
+
+	if s.il == nil {
+		return writeJson(w, http.StatusNotImplemented, outErrorV2{
+			"blinded paths need a backend with channel graph",
+		})
+	}
+	var params inBlindedPathsV2
+	if statusCode, err := decodeRequestV2(w, r, &params); err != nil {
+		return writeJson(w, statusCode, outErrorV2{err.Error()})
+	}
+	if len(params.Peers) == 0 || params.AmountMsat <= 0 {
+		return writeJson(w, http.StatusBadRequest, outErrorV2{
+			"peers and a positive amountMsat are required",
+		})
+	}
+	if params.MaxPaths <= 0 {
+		params.MaxPaths = defaultMaxPaths
+	}
+	params.MaxPaths = min(params.MaxPaths, maxMaxPaths)
+	log.Printf("-> %+v", params)
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.routeTimeout)
+	defer cancel()
+	paths, err := findBlindedPaths(
+		ctx, s.il, params.Peers, params.AmountMsat, params.MaxPaths,
+	)
+	if statusCode, failure := searchFailureV2(err); failure != nil {
+		return writeJson(w, statusCode, failure)
+	}
+
+	if paths == nil {
+		paths = []blindedPath{}
+	}
+	return writeJson(w, http.StatusOK, outBlindedPathsV2{paths})
+}
+
+func (s *server) recommendedNodesV2Handler(w http.ResponseWriter, r *http.Request) error {
+	const (
+		defaultMaxNodes = 10
+		maxMaxNodes     = 100
+	)
+	log.Println("request on GET /v2/router/recommendednodes")
+	w.Header().Set("Content-Type", "application/json")
+
+	if s.nr == nil {
+		return writeJson(w, http.StatusNotImplemented, outErrorV2{
+			"node recommendations need a backend with channel graph",
+		})
+	}
+	maxNodes := int64(defaultMaxNodes)
+	if v := r.URL.Query().Get("max"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return writeJson(w, http.StatusBadRequest, outErrorV2{
+				"max must be a positive integer",
+			})
+		}
+		maxNodes = min(n, maxMaxNodes)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.routeTimeout)
+	defer cancel()
+	nodes, err := s.nr.recommend(ctx, maxNodes)
+	if err != nil {
+		log.Println("error recommending nodes:", err)
+		return writeJson(w, http.StatusServiceUnavailable, outErrorV2{
+			"channel graph unavailable",
+		})
+	}
+	return writeJson(w, http.StatusOK, outRecommendedNodesV2{nodes})
+}
+
+// searchFailureV2 is the status and error returned for a failed search, nil
+// when the search error should rather yield no routes
+func searchFailureV2(err error) (int, *outErrorV2) {
+	switch {
+	case err == nil:
+		return http.StatusOK, nil
+	case errors.Is(err, errNoRouteWithinBudget):
+		log.Println("error getting routes: ", err)
+		return http.StatusUnprocessableEntity, &outErrorV2{errNoRouteWithinBudget.Error()}
+	case errors.Is(err, errLnUnavailable):
+		log.Println("error getting routes, lightning node unavailable: ", err)
+		return http.StatusServiceUnavailable, &outErrorV2{errLnUnavailable.Error()}
+	default:
+		log.Println("error getting routes, returning empty routes: ", err)
+		return http.StatusOK, nil
+	}
+}
+
+func toOutRouteV2(route PaymentRoute, msat int64) outRouteV2 {
+	r := outRouteV2{
+		AmountMsat: msat,
+		FeeMsat:    routeFeeMsat(route, msat),
+		Cltv:       routeCltv(route),
+		Hops:       make([]outHopV2, 0, len(route)),
+	}
+	if len(route) > 0 {
+		r.Source = route[0].NodeId
+	}
+	amounts := hopAmountsMsat(route, msat)
+	for i, hop := range route {
+		r.Hops = append(r.Hops, outHopV2{hop, amounts[i]})
+	}
+	return r
+}
+
+// maxRequestBytesV2 bounds the json bodies of the v2 requests
+const maxRequestBytesV2 = 64 << 10
+
+// decodeRequestV2 decodes the json body of the request into v, returning the
+// error status of a body too large or malformed
+func decodeRequestV2(w http.ResponseWriter, r *http.Request, v interface{}) (int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBytesV2)
+	err := json.NewDecoder(r.Body).Decode(v)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge, err
+	}
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, nil
+}
+
+func writeJson(w http.ResponseWriter, statusCode int, v interface{}) error {
+	log.Printf("<- %+v\n", v)
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
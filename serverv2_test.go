@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_routesV2Handler(t *testing.T) {
+	route := PaymentRoute{
+		{NodeId: "a", ShortChannelId: 1, CltvExpiryDelta: 40, FeeBaseMsat: 1000},
+		{NodeId: "b", ShortChannelId: 2, CltvExpiryDelta: 6},
+	}
+	s := newServer(nil, nil, listRouteFinder{route}, nil, nil, nil, time.Second, 3, 0, 0, "")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(
+		"POST", "/v2/router/routes",
+		strings.NewReader(`{"to":"c","amountMsat":100000}`),
+	)
+	tu.Must(t, s.routesV2Handler(w, r))
+
+	expected := `{"routes":[{"source":"a","amountMsat":100000,"feeMsat":1000,"cltv":46,"hops":[` +
+		`{"nodeId":"a","shortChannelId":1,"cltvExpireDelta":40,"htlcMinimumMsat":0,"feeBaseMsat":1000,"feeProportionalMillionths":0,"htlcMaximumMsat":0,"disabled":false,"features":"","amountMsat":100000},` +
+		`{"nodeId":"b","shortChannelId":2,"cltvExpireDelta":6,"htlcMinimumMsat":0,"feeBaseMsat":0,"feeProportionalMillionths":0,"htlcMaximumMsat":0,"disabled":false,"features":"","amountMsat":100000}` +
+		`]}]}` + "\n"
+	if !reflect.DeepEqual(expected, w.Body.String()) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/v2/router/routes", strings.NewReader(`{"to":"c"}`))
+	tu.Must(t, s.routesV2Handler(w, r))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(
+		"POST", "/v2/router/routes",
+		strings.NewReader(`{"from":["1","2","3","4","5","6","7","8","9"],"to":"c","amountMsat":100000}`),
+	)
+	tu.Must(t, s.routesV2Handler(w, r))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(
+		"POST", "/v2/router/routes",
+		strings.NewReader(`{"to":"`+strings.Repeat("c", maxRequestBytesV2)+`","amountMsat":100000}`),
+	)
+	tu.Must(t, s.routesV2Handler(w, r))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func Test_trampolineV2Handler(t *testing.T) {
+	rf := &fakeRouteFinder{
+		routes: map[string]PaymentRoute{
+			"t": {{NodeId: "a", ShortChannelId: 1, FeeBaseMsat: 1000, CltvExpiryDelta: 6}},
+			"c": {{NodeId: "t", ShortChannelId: 2, FeeBaseMsat: 500, CltvExpiryDelta: 40}},
+		},
+		msat: map[string]int64{},
+	}
+	s := newServer(nil, nil, rf, nil, nil, nil, time.Second, 3, 0, 0, "")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(
+		"POST", "/v2/router/trampoline",
+		strings.NewReader(`{"to":"c","trampoline":"t","amountMsat":100000}`),
+	)
+	tu.Must(t, s.trampolineV2Handler(w, r))
+
+	expected := `{"trampoline":"t","amountMsat":100000,"trampolineAmountMsat":100500,"trampolineFeeMsat":500,"trampolineCltvExpiryDelta":40,"routes":[` +
+		`{"source":"a","amountMsat":100500,"feeMsat":1000,"cltv":6,"hops":[` +
+		`{"nodeId":"a","shortChannelId":1,"cltvExpireDelta":6,"htlcMinimumMsat":0,"feeBaseMsat":1000,"feeProportionalMillionths":0,"htlcMaximumMsat":0,"disabled":false,"features":"","amountMsat":100500}` +
+		`]}],"innerRoute":{"source":"t","amountMsat":100000,"feeMsat":500,"cltv":40,"hops":[` +
+		`{"nodeId":"t","shortChannelId":2,"cltvExpireDelta":40,"htlcMinimumMsat":0,"feeBaseMsat":500,"feeProportionalMillionths":0,"htlcMaximumMsat":0,"disabled":false,"features":"","amountMsat":100000}` +
+		`]}}` + "\n"
+	if !reflect.DeepEqual(expected, w.Body.String()) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(
+		"POST", "/v2/router/trampoline",
+		strings.NewReader(`{"to":"c","amountMsat":100000}`),
+	)
+	tu.Must(t, s.trampolineV2Handler(w, r))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"master.private/bstd.git/stackerr"
+)
+
+// trampolinePayment is a payment through a trampoline node: the wallet pays
+// the trampoline node along one of the routes, and the trampoline node
+// forwards msat to the destination for the fee, within the cltv delta
+type trampolinePayment struct {
+	// Routes reach the trampoline node with msat plus the trampoline fee
+	Routes            []PaymentRoute
+	TrampolineFeeMsat int64
+	TrampolineCltv    int64
+	// InnerRoute is the trampoline to destination route the trampoline fee
+	// and cltv delta were computed from
+	InnerRoute PaymentRoute
+}
+
+// findTrampolinePayment finds the best route from the trampoline node to the
+// destination, then the routes from the sources to the trampoline node
+// within what the inner route left of the limits
+func findTrampolinePayment(
+	ctx context.Context,
+	rf RouteFinder,
+	fromPubkeys []string,
+	trampoline string,
+	toPubkey string,
+	msat int64,
+	excl RouteExclusions,
+	limits RouteLimits,
+) (trampolinePayment, error) {
+	inner, err := rf.FindRoutes(ctx, []string{trampoline}, toPubkey, msat, excl, limits)
+	if err != nil {
+		return trampolinePayment{}, stackerr.Wrap(err)
+	}
+	if len(inner) == 0 {
+		return trampolinePayment{}, stackerr.Wrap(
+			fmt.Errorf("no route from trampoline %s to %s", trampoline, toPubkey),
+		)
+	}
+	r := trampolinePayment{
+		TrampolineFeeMsat: routeFeeMsat(inner[0], msat),
+		TrampolineCltv:    routeCltv(inner[0]),
+		InnerRoute:        inner[0],
+	}
+
+	outerLimits := RouteLimits{
+		MaxFeeMsat: remainingLimit(limits.maxFeeMsat(msat), r.TrampolineFeeMsat),
+		MaxCltv:    remainingLimit(limits.MaxCltv, r.TrampolineCltv),
+		MaxHops:    remainingLimit(limits.MaxHops, int64(len(r.InnerRoute))),
+	}
+	if outerLimits.MaxFeeMsat < 0 || outerLimits.MaxCltv < 0 || outerLimits.MaxHops < 0 {
+		return trampolinePayment{}, stackerr.Wrap(errNoRouteWithinBudget)
+	}
+	r.Routes, err = rf.FindRoutes(
+		ctx, fromPubkeys, trampoline, msat+r.TrampolineFeeMsat, excl, outerLimits,
+	)
+	if err != nil {
+		return trampolinePayment{}, stackerr.Wrap(err)
+	}
+	return r, nil
+}
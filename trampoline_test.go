@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	tu "master.private/bstd.git/testutil"
+)
+
+func Test_findTrampolinePayment(t *testing.T) {
+	rf := &fakeRouteFinder{
+		routes: map[string]PaymentRoute{
+			"t": {{NodeId: "a", ShortChannelId: 1, FeeBaseMsat: 1000, CltvExpiryDelta: 6}},
+			"c": {
+				{NodeId: "t", ShortChannelId: 2, FeeProportionalMillionths: 1000, CltvExpiryDelta: 40},
+				{NodeId: "b", ShortChannelId: 3, FeeBaseMsat: 500, CltvExpiryDelta: 80},
+			},
+		},
+		msat: map[string]int64{},
+	}
+
+	ctx := context.Background()
+	r, err := findTrampolinePayment(
+		ctx, rf, nil, "t", "c", 1_000_000, RouteExclusions{}, RouteLimits{},
+	)
+	tu.Must(t, err)
+
+	expected := trampolinePayment{
+		Routes:            []PaymentRoute{rf.routes["t"]},
+		TrampolineFeeMsat: 500 + 1000,
+		TrampolineCltv:    120,
+		InnerRoute:        rf.routes["c"],
+	}
+	if !reflect.DeepEqual(expected, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", expected, r)
+	}
+	// the trampoline node receives the amount plus its fee
+	if rf.msat["t"] != 1_001_500 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 1_001_500, rf.msat["t"])
+	}
+
+	// the inner route spends the whole hop budget
+	_, err = findTrampolinePayment(
+		ctx, rf, nil, "t", "c", 1_000_000, RouteExclusions{}, RouteLimits{MaxHops: 2},
+	)
+	if !errors.Is(err, errNoRouteWithinBudget) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", errNoRouteWithinBudget, err)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -12,39 +14,80 @@ import (
 
 func decodeInRoutes(hexStr []byte) (inRoutes, error) {
 	var r inRoutes
+	err := decodeHexJson(hexStr, &r)
+	if err != nil {
+		return r, stackerr.Wrap(err)
+	}
+	return r, nil
+}
+
+// decodeHexJson decodes the hex encoded json params of a request into v
+func decodeHexJson(hexStr []byte, v interface{}) error {
 	res := make([]byte, len(hexStr)/2+1)
 	n, err := hex.Decode(res, hexStr)
 	if err != nil {
-		return r, stackerr.Wrap(err)
+		return stackerr.Wrap(err)
 	}
-	res = res[:n]
-	err = json.Unmarshal(res, &r)
+	err = json.Unmarshal(res[:n], v)
 	if err != nil {
-		return r, stackerr.Wrap(err)
+		return stackerr.Wrap(err)
 	}
-	return r, nil
+	return nil
 }
 
 func mustShortChannelIdToInt(scid string) int64 {
+	r, err := shortChannelIdToInt(scid)
+	if err != nil {
+		panic(stackerr.Wrap(err))
+	}
+	return r
+}
+
+func shortChannelIdToInt(scid string) (int64, error) {
 	const nParts = 3
 	var ints [nParts]int64
 	nums := strings.Split(scid, "x")
 	if n := len(nums); n != nParts {
-		panic(stackerr.Wrap(fmt.Errorf("expecting %d separators, got %d", nParts, n)))
+		return 0, stackerr.Wrap(fmt.Errorf("expecting %d separators, got %d", nParts, n))
 	}
 	for i := range nParts {
 		asInt, err := strconv.ParseInt(string(nums[i]), 10, 64)
 		if err != nil {
-			panic(stackerr.Wrap(err))
+			return 0, stackerr.Wrap(err)
 		}
 		ints[i] = asInt
 	}
+	if ints[0] < 0 || ints[0] >= 1<<24 ||
+		ints[1] < 0 || ints[1] >= 1<<24 ||
+		ints[2] < 0 || ints[2] >= 1<<16 {
+		return 0, stackerr.Wrap(fmt.Errorf("short channel id out of range: %s", scid))
+	}
 
 	// Block Height (24 bits) (<< 40)
 	// Transaction Index (24 bits) (<< 16)
 	// Output Index (16 bits) (<< 0)
 	result := ints[0]<<40 | ints[1]<<16 | ints[2]
-	return result
+	return result, nil
+}
+
+// parseShortChannelId accepts the short channel id either as
+// block x transaction x output or as its int64 form
+func parseShortChannelId(scid string) (int64, error) {
+	if strings.Contains(scid, "x") {
+		r, err := shortChannelIdToInt(scid)
+		if err != nil {
+			return 0, stackerr.Wrap(err)
+		}
+		return r, nil
+	}
+	r, err := strconv.ParseInt(scid, 10, 64)
+	if err != nil {
+		return 0, stackerr.Wrap(err)
+	}
+	if r <= 0 {
+		return 0, stackerr.Wrap(fmt.Errorf("invalid short channel id: %s", scid))
+	}
+	return r, nil
 }
 
 func shortChannelIdToString(scid int64) string {
@@ -56,29 +99,100 @@ func shortChannelIdToString(scid int64) string {
 	return fmt.Sprintf("%dx%dx%d", ints[0], ints[1], ints[2])
 }
 
-func serializeRoutes(routes []PaymentRoute) [][]string {
+func serializeRoutes(routes []PaymentRoute) ([][]string, error) {
 	var serializedRoutes [][]string
 	var hopSwap [118]byte
 
 	for _, route := range routes {
-		var serializedRoute []string
+		serializedRoute := make([]string, 0, len(route))
 		for _, hop := range route {
-			hopBytes := serializeHop(hop)
+			hopBytes, err := serializeHop(hop)
+			if err != nil {
+				return nil, stackerr.Wrap(err)
+			}
 			hex.Encode(hopSwap[:], hopBytes[:])
 			serializedRoute = append(serializedRoute, string(hopSwap[:]))
 		}
 		serializedRoutes = append(serializedRoutes, serializedRoute)
 	}
 
-	return serializedRoutes
+	return serializedRoutes, nil
+}
+
+// serializeParts serializes each payment part as its serialized route
+// followed by its amount
+func serializeParts(
+	parts []paymentPart, hopVersion int64,
+) ([][]interface{}, error) {
+	serializedParts := make([][]interface{}, 0, len(parts))
+	for _, part := range parts {
+		routes, err := serializeRoutesVersion(
+			[]PaymentRoute{part.Route}, part.AmountMsat, hopVersion,
+		)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		serializedParts = append(serializedParts, []interface{}{
+			routes[0], part.AmountMsat,
+		})
+	}
+	return serializedParts, nil
+}
+
+// hop serialization versions, requested by the wallets
+const (
+	// the fixed 59 bytes layout of serializeHop, the default
+	hopVersionLegacy = 1
+	// the tlv stream of serializeHopTlv
+	hopVersionTlv = 2
+)
+
+var errUnsupportedHopVersion = errors.New("unsupported hop version")
+
+func validHopVersion(hopVersion int64) bool {
+	return hopVersion == 0 || hopVersion == hopVersionLegacy ||
+		hopVersion == hopVersionTlv
 }
 
-func serializeHop(hop Hop) [59]byte {
+// serializeRoutesVersion serializes the routes delivering msat with the hop
+// serialization version, 0 being the legacy one
+func serializeRoutesVersion(
+	routes []PaymentRoute, msat int64, hopVersion int64,
+) ([][]string, error) {
+	if hopVersion != hopVersionTlv {
+		r, err := serializeRoutes(routes)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		return r, nil
+	}
+	var serializedRoutes [][]string
+	for _, route := range routes {
+		amounts := hopAmountsMsat(route, msat)
+		serializedRoute := make([]string, 0, len(route))
+		for i, hop := range route {
+			b, err := serializeHopTlv(hop, amounts[i])
+			if err != nil {
+				return nil, stackerr.Wrap(err)
+			}
+			serializedRoute = append(serializedRoute, hex.EncodeToString(b))
+		}
+		serializedRoutes = append(serializedRoutes, serializedRoute)
+	}
+	return serializedRoutes, nil
+}
+
+func serializeHop(hop Hop) ([59]byte, error) {
 	r := [59]byte{}
 
 	// pubkey (33 bytes BE)
+	if len(hop.NodeId) != 66 {
+		return r, stackerr.Wrap(fmt.Errorf("invalid hop node id %q", hop.NodeId))
+	}
 	_, err := hex.Decode(r[:33], []byte(hop.NodeId))
-	must(err)
+	if err != nil {
+		return r, stackerr.Wrap(err)
+	}
 
 	// short channel id (8 bytes BE)
 	r[33] = byte(hop.ShortChannelId >> (7 * 8))
@@ -116,5 +230,200 @@ func serializeHop(hop Hop) [59]byte {
 	r[57] = byte(hop.FeeProportionalMillionths >> (1 * 8))
 	r[58] = byte(hop.FeeProportionalMillionths >> (0 * 8))
 
-	return r
+	return r, nil
+}
+
+// decodeHop decodes a hop in the legacy 59 bytes layout
+func decodeHop(b []byte) (Hop, error) {
+	if len(b) != 59 {
+		return Hop{}, fmt.Errorf("invalid hop length %d", len(b))
+	}
+	return Hop{
+		NodeId:                    hex.EncodeToString(b[:33]),
+		ShortChannelId:            int64(binary.BigEndian.Uint64(b[33:41])),
+		CltvExpiryDelta:           int16(binary.BigEndian.Uint16(b[41:43])),
+		HtlcMinimumMsat:           int64(binary.BigEndian.Uint64(b[43:51])),
+		FeeBaseMsat:               int32(binary.BigEndian.Uint32(b[51:55])),
+		FeeProportionalMillionths: int32(binary.BigEndian.Uint32(b[55:59])),
+	}, nil
+}
+
+// hop tlv record types. As in the lightning tlv streams, a reader ignores
+// the odd types it doesn't know and rejects the unknown even ones, so new
+// optional fields take odd types.
+const (
+	hopTlvNodeId                    = 0
+	hopTlvShortChannelId            = 2
+	hopTlvCltvExpiryDelta           = 4
+	hopTlvHtlcMinimumMsat           = 6
+	hopTlvFeeBaseMsat               = 8
+	hopTlvFeeProportionalMillionths = 10
+	hopTlvHtlcMaximumMsat           = 11
+	hopTlvAmountMsat                = 13
+	hopTlvFeatures                  = 15
+)
+
+// serializeHopTlv serializes the hop as a tlv stream, with the amount it
+// forwards. Integers are truncated big endian, types and lengths bigsize.
+func serializeHopTlv(hop Hop, amountMsat int64) ([]byte, error) {
+	nodeId, err := hex.DecodeString(hop.NodeId)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	if len(nodeId) != 33 {
+		return nil, stackerr.Wrap(fmt.Errorf("invalid hop node id %q", hop.NodeId))
+	}
+	features, err := hex.DecodeString(hop.Features)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+
+	var r []byte
+	record := func(t uint64, v []byte) {
+		r = appendBigSize(r, t)
+		r = appendBigSize(r, uint64(len(v)))
+		r = append(r, v...)
+	}
+	record(hopTlvNodeId, nodeId)
+	record(hopTlvShortChannelId, binary.BigEndian.AppendUint64(nil, uint64(hop.ShortChannelId)))
+	record(hopTlvCltvExpiryDelta, truncatedUint(uint64(uint16(hop.CltvExpiryDelta))))
+	record(hopTlvHtlcMinimumMsat, truncatedUint(uint64(hop.HtlcMinimumMsat)))
+	record(hopTlvFeeBaseMsat, truncatedUint(uint64(uint32(hop.FeeBaseMsat))))
+	record(hopTlvFeeProportionalMillionths, truncatedUint(uint64(uint32(hop.FeeProportionalMillionths))))
+	if hop.HtlcMaximumMsat > 0 {
+		record(hopTlvHtlcMaximumMsat, truncatedUint(uint64(hop.HtlcMaximumMsat)))
+	}
+	record(hopTlvAmountMsat, truncatedUint(uint64(amountMsat)))
+	if len(features) > 0 {
+		record(hopTlvFeatures, features)
+	}
+	return r, nil
+}
+
+// decodeHopTlv decodes a hop serialized by serializeHopTlv, returning the
+// hop and the amount it forwards
+func decodeHopTlv(b []byte) (Hop, int64, error) {
+	var (
+		hop        Hop
+		amountMsat int64
+		lastType   uint64
+		seen       = map[uint64]bool{}
+	)
+	// records are in strictly increasing type order
+	for len(b) > 0 {
+		t, n, err := readBigSize(b)
+		if err != nil {
+			return hop, 0, stackerr.Wrap(err)
+		}
+		b = b[n:]
+		l, n, err := readBigSize(b)
+		if err != nil {
+			return hop, 0, stackerr.Wrap(err)
+		}
+		b = b[n:]
+		if uint64(len(b)) < l {
+			return hop, 0, fmt.Errorf("tlv record %d overflow", t)
+		}
+		if len(seen) > 0 && t <= lastType {
+			return hop, 0, fmt.Errorf("tlv record %d out of order", t)
+		}
+		v := b[:l]
+		b = b[l:]
+		lastType = t
+		seen[t] = true
+
+		switch t {
+		case hopTlvNodeId:
+			if l != 33 {
+				return hop, 0, fmt.Errorf("invalid node id length %d", l)
+			}
+			hop.NodeId = hex.EncodeToString(v)
+		case hopTlvShortChannelId:
+			if l != 8 {
+				return hop, 0, fmt.Errorf("invalid short channel id length %d", l)
+			}
+			hop.ShortChannelId = int64(binary.BigEndian.Uint64(v))
+		case hopTlvFeatures:
+			hop.Features = hex.EncodeToString(v)
+		case hopTlvCltvExpiryDelta, hopTlvHtlcMinimumMsat, hopTlvFeeBaseMsat,
+			hopTlvFeeProportionalMillionths, hopTlvHtlcMaximumMsat, hopTlvAmountMsat:
+			if l > 8 {
+				return hop, 0, fmt.Errorf("invalid tlv record %d length %d", t, l)
+			}
+			var n uint64
+			for _, c := range v {
+				n = n<<8 | uint64(c)
+			}
+			switch t {
+			case hopTlvCltvExpiryDelta:
+				hop.CltvExpiryDelta = int16(n)
+			case hopTlvHtlcMinimumMsat:
+				hop.HtlcMinimumMsat = int64(n)
+			case hopTlvFeeBaseMsat:
+				hop.FeeBaseMsat = int32(n)
+			case hopTlvFeeProportionalMillionths:
+				hop.FeeProportionalMillionths = int32(n)
+			case hopTlvHtlcMaximumMsat:
+				hop.HtlcMaximumMsat = int64(n)
+			case hopTlvAmountMsat:
+				amountMsat = int64(n)
+			}
+		default:
+			if t%2 == 0 {
+				return hop, 0, fmt.Errorf("unknown even tlv record %d", t)
+			}
+		}
+	}
+	if !seen[hopTlvNodeId] || !seen[hopTlvShortChannelId] {
+		return hop, 0, fmt.Errorf("missing hop node id or short channel id")
+	}
+	return hop, amountMsat, nil
+}
+
+// truncatedUint encodes v big endian without its leading zero bytes
+func truncatedUint(v uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func appendBigSize(b []byte, v uint64) []byte {
+	switch {
+	case v < 0xfd:
+		return append(b, byte(v))
+	case v <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, 0xfd), uint16(v))
+	case v <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, 0xfe), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xff), v)
+}
+
+// readBigSize decodes the bigsize at the start of b, returning it with its
+// length
+func readBigSize(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, fmt.Errorf("missing bigsize")
+	}
+	var n int
+	switch b[0] {
+	case 0xfd:
+		n = 2
+	case 0xfe:
+		n = 4
+	case 0xff:
+		n = 8
+	default:
+		return uint64(b[0]), 1, nil
+	}
+	if len(b) < 1+n {
+		return 0, 0, fmt.Errorf("truncated bigsize")
+	}
+	var v uint64
+	for _, c := range b[1 : 1+n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, 1 + n, nil
 }
@@ -49,3 +49,97 @@ func Test_shortChannelIdToString(t *testing.T) {
 		t.Fatal("unexpected:", string(r))
 	}
 }
+
+func Test_decodeHop(t *testing.T) {
+	hop := Hop{
+		NodeId:                    "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		ShortChannelId:            556369376388317185,
+		CltvExpiryDelta:           144,
+		HtlcMinimumMsat:           1000,
+		FeeBaseMsat:               1000,
+		FeeProportionalMillionths: 100,
+	}
+	b, err := serializeHop(hop)
+	tu.Must(t, err)
+	r, err := decodeHop(b[:])
+	tu.Must(t, err)
+
+	if !reflect.DeepEqual(hop, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", hop, r)
+	}
+}
+
+func Test_decodeHopTlv(t *testing.T) {
+	hop := Hop{
+		NodeId:                    "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		ShortChannelId:            556369376388317185,
+		CltvExpiryDelta:           144,
+		HtlcMinimumMsat:           0,
+		FeeBaseMsat:               1000,
+		FeeProportionalMillionths: 100,
+		HtlcMaximumMsat:           5_000_000_000,
+		Features:                  "0102",
+	}
+	b, err := serializeHopTlv(hop, 1_000_000)
+	tu.Must(t, err)
+	r, amountMsat, err := decodeHopTlv(b)
+	tu.Must(t, err)
+
+	if !reflect.DeepEqual(hop, r) {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", hop, r)
+	}
+	if amountMsat != 1_000_000 {
+		t.Fatalf("expecting: %+v\ngot: %+v\n", 1_000_000, amountMsat)
+	}
+
+	// records of unknown odd types are ignored, of unknown even types
+	// rejected
+	_, _, err = decodeHopTlv(append(b, 0xfd, 0x01, 0x01, 0x01, 0xff))
+	tu.Must(t, err)
+	_, _, err = decodeHopTlv(append(b, 0xfd, 0x01, 0x00, 0x01, 0xff))
+	if err == nil {
+		t.Fatalf("expecting error for unknown even record")
+	}
+}
+
+func Test_serializeRoutesVersion(t *testing.T) {
+	hop := Hop{
+		NodeId:         "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		ShortChannelId: 556369376388317185,
+	}
+	for _, hopVersion := range []int64{hopVersionLegacy, hopVersionTlv} {
+		_, err := serializeRoutesVersion([]PaymentRoute{{hop}}, 1000, hopVersion)
+		tu.Must(t, err)
+	}
+
+	// the malformed hops of a backend are an error, not a crash
+	invalid := []Hop{
+		{NodeId: "02aa", ShortChannelId: 1},
+		{NodeId: "zz" + hop.NodeId[2:], ShortChannelId: 1},
+		{NodeId: hop.NodeId, ShortChannelId: 1, Features: "0x"},
+	}
+	for i, v := range invalid {
+		hopVersions := []int64{hopVersionLegacy, hopVersionTlv}
+		if v.Features != "" {
+			// the legacy layout has no features
+			hopVersions = hopVersions[1:]
+		}
+		for _, hopVersion := range hopVersions {
+			_, err := serializeRoutesVersion([]PaymentRoute{{v}}, 1000, hopVersion)
+			if err == nil {
+				t.Fatalf("%d: expecting an error for hop version %d", i, hopVersion)
+			}
+		}
+	}
+}
+
+func Test_readBigSize(t *testing.T) {
+	for _, v := range []uint64{0, 0xfc, 0xfd, 0xffff, 0x10000, 0xffffffff, 0x100000000} {
+		b := appendBigSize(nil, v)
+		r, n, err := readBigSize(b)
+		tu.Must(t, err)
+		if r != v || n != len(b) {
+			t.Fatalf("expecting: %+v\ngot: %+v\n", v, r)
+		}
+	}
+}